@@ -0,0 +1,280 @@
+package gofigure
+
+import "fmt"
+
+// toFloat converts a numeric event value to a float64.
+func toFloat(v interface{}) (float64, bool) {
+	if i, ok := v.(int); ok {
+		return float64(i), true
+	} else if f, ok := v.(float64); ok {
+		return f, true
+	}
+	return 0, false
+}
+
+// aggregate folds a list of values with the given method. Non-numeric values
+// are ignored by SUM and AVG; MIN and MAX compare numbers numerically and fall
+// back to comparing strings when the list contains no numbers.
+func aggregate(method AggregateMethod, collection []interface{}) interface{} {
+	state := newAggState(method)
+	for _, entry := range collection {
+		state.add(entry)
+	}
+	return state.result()
+}
+
+// aggState is the running state of an aggregate, updated one value at a
+// time so REDUCE never has to hold the values it aggregates.
+type aggState interface {
+	add(v interface{})
+	// merge folds in the state of the same aggregate over other values, as
+	// if they had been added to this one.
+	merge(other aggState)
+	result() interface{}
+	// size estimates the bytes the state takes in memory.
+	size() int
+	// encode and decode write the state to a spill file and read it back.
+	encode(w *spillWriter)
+	decode(r *spillReader)
+}
+
+// stateOverhead estimates the bytes taken by a state of fixed size, with
+// the interface and pointer referring to it.
+const stateOverhead = 48
+
+func newAggState(method AggregateMethod) aggState {
+	switch method {
+	case AGG_SUM:
+		return &sumState{}
+	case AGG_COUNT:
+		return &countState{}
+	case AGG_AVG:
+		return &avgState{}
+	case AGG_MIN:
+		return &extremeState{}
+	case AGG_MAX:
+		return &extremeState{max: true}
+	case AGG_DISTINCT_COUNT:
+		return &distinctState{seen: make(map[string]bool)}
+	case AGG_APPROX_DISTINCT_COUNT:
+		return &approxDistinctState{sketch: newHyperLogLog()}
+	}
+	return &nullState{}
+}
+
+type sumState struct {
+	sum float64
+}
+
+func (s *sumState) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		s.sum += f
+	}
+}
+
+func (s *sumState) merge(other aggState) { s.sum += other.(*sumState).sum }
+
+func (s *sumState) result() interface{} { return s.sum }
+
+func (s *sumState) size() int { return stateOverhead }
+
+func (s *sumState) encode(w *spillWriter) { w.float(s.sum) }
+
+func (s *sumState) decode(r *spillReader) { s.sum = r.float() }
+
+// countState counts every value, including nulls.
+type countState struct {
+	n int
+}
+
+func (s *countState) add(v interface{}) { s.n++ }
+
+func (s *countState) merge(other aggState) { s.n += other.(*countState).n }
+
+func (s *countState) result() interface{} { return s.n }
+
+func (s *countState) size() int { return stateOverhead }
+
+func (s *countState) encode(w *spillWriter) { w.uvarint(uint64(s.n)) }
+
+func (s *countState) decode(r *spillReader) { s.n = int(r.uvarint()) }
+
+type avgState struct {
+	sum float64
+	n   int
+}
+
+func (s *avgState) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		s.sum += f
+		s.n++
+	}
+}
+
+func (s *avgState) merge(other aggState) {
+	o := other.(*avgState)
+	s.sum += o.sum
+	s.n += o.n
+}
+
+func (s *avgState) result() interface{} {
+	if s.n == 0 {
+		return nil
+	}
+	return s.sum / float64(s.n)
+}
+
+func (s *avgState) size() int { return stateOverhead }
+
+func (s *avgState) encode(w *spillWriter) {
+	w.float(s.sum)
+	w.uvarint(uint64(s.n))
+}
+
+func (s *avgState) decode(r *spillReader) {
+	s.sum = r.float()
+	s.n = int(r.uvarint())
+}
+
+// extremeState keeps the largest (max) or smallest number and string seen.
+type extremeState struct {
+	max bool
+	num interface{}
+	str interface{}
+}
+
+func (s *extremeState) add(v interface{}) {
+	if f, ok := toFloat(v); ok {
+		if cur, ok := s.num.(float64); !ok || (s.max && f > cur) || (!s.max && f < cur) {
+			s.num = f
+		}
+	} else if str, ok := v.(string); ok {
+		if cur, ok := s.str.(string); !ok || (s.max && str > cur) || (!s.max && str < cur) {
+			s.str = str
+		}
+	}
+}
+
+func (s *extremeState) merge(other aggState) {
+	o := other.(*extremeState)
+	if o.num != nil {
+		s.add(o.num)
+	}
+	if o.str != nil {
+		s.add(o.str)
+	}
+}
+
+func (s *extremeState) result() interface{} {
+	if s.num != nil {
+		return s.num
+	}
+	return s.str
+}
+
+func (s *extremeState) size() int {
+	str, _ := s.str.(string)
+	return stateOverhead + len(str)
+}
+
+func (s *extremeState) encode(w *spillWriter) {
+	w.value(s.num)
+	w.value(s.str)
+}
+
+func (s *extremeState) decode(r *spillReader) {
+	s.num = r.value()
+	s.str = r.value()
+}
+
+// distinctState counts distinct non-null values exactly.
+type distinctState struct {
+	seen map[string]bool
+	// keyBytes is the length of the keys in seen, for size.
+	keyBytes int
+}
+
+func (s *distinctState) add(v interface{}) {
+	if v != nil {
+		s.addKey(distinctKey(v))
+	}
+}
+
+func (s *distinctState) addKey(key string) {
+	if !s.seen[key] {
+		s.seen[key] = true
+		s.keyBytes += len(key)
+	}
+}
+
+func (s *distinctState) merge(other aggState) {
+	for k := range other.(*distinctState).seen {
+		s.addKey(k)
+	}
+}
+
+func (s *distinctState) result() interface{} { return len(s.seen) }
+
+func (s *distinctState) size() int {
+	// Each map entry costs about 40 bytes on top of its key.
+	return stateOverhead + 40*len(s.seen) + s.keyBytes
+}
+
+func (s *distinctState) encode(w *spillWriter) {
+	w.uvarint(uint64(len(s.seen)))
+	for k := range s.seen {
+		w.string(k)
+	}
+}
+
+func (s *distinctState) decode(r *spillReader) {
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		s.addKey(r.string())
+	}
+}
+
+// approxDistinctState estimates the number of distinct non-null values.
+type approxDistinctState struct {
+	sketch *hyperLogLog
+}
+
+func (s *approxDistinctState) add(v interface{}) {
+	if v != nil {
+		s.sketch.add(distinctKey(v))
+	}
+}
+
+func (s *approxDistinctState) merge(other aggState) {
+	s.sketch.merge(other.(*approxDistinctState).sketch)
+}
+
+func (s *approxDistinctState) result() interface{} { return s.sketch.estimate() }
+
+func (s *approxDistinctState) size() int { return stateOverhead + len(s.sketch.registers) }
+
+func (s *approxDistinctState) encode(w *spillWriter) { w.bytes(s.sketch.registers) }
+
+func (s *approxDistinctState) decode(r *spillReader) {
+	s.sketch = &hyperLogLog{registers: r.bytes()}
+}
+
+// distinctKey identifies a value for the distinct counts, telling apart
+// values of different types such as 1 and "1".
+func distinctKey(v interface{}) string {
+	return fmt.Sprintf("%T:%v", v, v)
+}
+
+// nullState is the state of an unknown aggregate method.
+type nullState struct{}
+
+func (s *nullState) add(v interface{}) {}
+
+func (s *nullState) merge(other aggState) {}
+
+func (s *nullState) result() interface{} { return nil }
+
+func (s *nullState) size() int { return stateOverhead }
+
+func (s *nullState) encode(w *spillWriter) {}
+
+func (s *nullState) decode(r *spillReader) {}
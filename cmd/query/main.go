@@ -0,0 +1,100 @@
+package main
+
+// Go provides a `flag` package supporting basic
+// command-line flag parsing. We'll use this package to
+// implement our example command-line program.
+import "context"
+import "encoding/json"
+import "errors"
+import "flag"
+import "fmt"
+import "os"
+import "os/signal"
+import "runtime"
+import "strings"
+import "time"
+import "github.com/jbwyme/gofigure"
+
+func main() {
+	queryPtr := flag.String("query", "", "Query to run. E.g. \"MAP field_1, field_2 REDUCE ON field_1\"")
+	startPtr := flag.Int64("start", 0, "Start date (in seconds, inclusive)")
+	endPtr := flag.Int64("end", time.Now().Unix(), "End date (in seconds, exclusive)")
+	tzPtr := flag.String("tz", "UTC", "Timezone for time bucketing functions. E.g. \"America/New_York\"")
+	dirPtr := flag.String("dir", "data", "Directory holding the daily event files")
+	workersPtr := flag.Int("workers", runtime.NumCPU(), "Number of files or chunks of files to scan at once")
+	memoryPtr := flag.Int64("memory-limit", 1024, "Megabytes of REDUCE groups to hold in memory before spilling to disk. 0 for no limit")
+	tmpDirPtr := flag.String("tmp-dir", "", "Directory for spill files. Defaults to the system's temporary directory")
+	timeoutPtr := flag.Duration("timeout", 0, "Longest the query may run, e.g. \"30s\". 0 for no limit")
+	flag.Parse()
+
+	loc, err := time.LoadLocation(*tzPtr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	q, err := gofigure.Parse(*queryPtr)
+	if err != nil {
+		var parseErr *gofigure.ParseError
+		if errors.As(err, &parseErr) {
+			printParseError(*queryPtr, parseErr)
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+
+	engine := &gofigure.Engine{
+		Location:    loc,
+		Workers:     *workersPtr,
+		MemoryLimit: *memoryPtr << 20,
+		TempDir:     *tmpDirPtr,
+	}
+	tr := gofigure.TimeRange{Start: time.Unix(*startPtr, 0), End: time.Unix(*endPtr, 0)}
+	// Stop the query on Ctrl-C, reporting how far it got.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeoutPtr > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancel()
+	}
+
+	result, err := engine.Execute(ctx, gofigure.DirStore{Dir: *dirPtr}, q, tr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if resultStr, err := json.Marshal(result); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	} else {
+		fmt.Printf("%s", resultStr)
+	}
+}
+
+// printParseError prints err with the offending line of the query and a
+// caret under the column the error was found at.
+func printParseError(query string, err *gofigure.ParseError) {
+	fmt.Println(err)
+	lines := strings.Split(query, "\n")
+	if err.Line < 1 || err.Line > len(lines) {
+		return
+	}
+	line := lines[err.Line-1]
+	fmt.Println("  " + line)
+
+	// Copy tabs so the caret lines up however the terminal renders them.
+	pad := make([]rune, 0, err.Column)
+	for i, ch := range []rune(line) {
+		if i >= err.Column-1 {
+			break
+		} else if ch == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	fmt.Println("  " + string(pad) + "^")
+}
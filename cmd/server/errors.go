@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jbwyme/gofigure"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of an error response.
+const (
+	codeMissingParam = "missing_param"
+	codeInvalidParam = "invalid_param"
+	codeInvalidBody  = "invalid_body"
+	codeInvalidEvent = "invalid_event"
+	codeParseError   = "parse_error"
+	codeQueryTimeout = "query_timeout"
+	codeInternal     = "internal_error"
+)
+
+// ErrorPosition locates a parse error in the query text.
+type ErrorPosition struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// APIError is the body of every error response, wrapped as {"error": ...}.
+type APIError struct {
+	Code     string         `json:"code"`
+	Message  string         `json:"message"`
+	Position *ErrorPosition `json:"position,omitempty"`
+	// Stats is the work a query did before it was stopped.
+	Stats *gofigure.Stats `json:"stats,omitempty"`
+}
+
+// positioner is implemented by errors that know where in the query they
+// occurred.
+type positioner interface {
+	Position() (line, column int)
+}
+
+// writeError writes an error response with the given status. If err carries
+// a query position or the stats of a stopped query they are included.
+func writeError(w http.ResponseWriter, status int, code string, message string, err error) {
+	apiErr := APIError{Code: code, Message: message}
+	var p positioner
+	if errors.As(err, &p) {
+		line, column := p.Position()
+		apiErr.Position = &ErrorPosition{Line: line, Column: column}
+	}
+	var canceled *gofigure.CanceledError
+	if errors.As(err, &canceled) {
+		apiErr.Stats = &canceled.Stats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error APIError `json:"error"`
+	}{apiErr})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/jbwyme/gofigure"
+)
+
+// maxEventsBody caps the size of a /events body, after decompression.
+const maxEventsBody = 64 << 20
+
+// EventRejection says why the event at Index was not written.
+type EventRejection struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// EventsResponse lists which events of a batch were written.
+type EventsResponse struct {
+	Accepted []int            `json:"accepted"`
+	Rejected []EventRejection `json:"rejected"`
+}
+
+// Events ingests a batch of events POSTed as a JSON array or as newline
+// delimited JSON, optionally gzip encoded. Each event is validated and
+// written on its own, and the response lists which were accepted.
+func Events(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxEventsBody)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, codeInvalidBody, "body is not valid gzip", nil)
+			return
+		}
+		defer gz.Close()
+		body = &maxBytesReader{r: gz, limit: maxEventsBody}
+	}
+
+	events, err := readEvents(bufio.NewReader(body))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, codeInvalidBody, err.Error(), nil)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, codeInvalidBody, err.Error(), nil)
+		return
+	}
+
+	res := EventsResponse{Accepted: make([]int, 0), Rejected: make([]EventRejection, 0)}
+	for i, event := range events {
+		if err := gofigure.ValidateEvent(event); err != nil {
+			res.Rejected = append(res.Rejected, EventRejection{Index: i, Error: err.Error()})
+			continue
+		}
+
+		// Events are stored one per line, so drop any formatting.
+		var line bytes.Buffer
+		json.Compact(&line, event)
+		if err := writer.Write(line.String()); err != nil {
+			log.Println(err)
+			res.Rejected = append(res.Rejected, EventRejection{Index: i, Error: "failed to write event"})
+			continue
+		}
+		res.Accepted = append(res.Accepted, i)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// maxBytesReader reads at most limit bytes from r. Reading past them fails
+// with an *http.MaxBytesError, as http.MaxBytesReader does for a body, so a
+// body too large once decompressed is rejected rather than cut short.
+type maxBytesReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.read > m.limit {
+		return 0, &http.MaxBytesError{Limit: m.limit}
+	}
+	// Read one byte past the limit, to tell whether there is more.
+	if left := m.limit - m.read + 1; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := m.r.Read(p)
+	m.read += int64(n)
+	if m.read > m.limit {
+		return n - 1, &http.MaxBytesError{Limit: m.limit}
+	}
+	return n, err
+}
+
+// readEvents splits a body into raw events. A body starting with "[" is
+// read as a JSON array and must be valid JSON as a whole; otherwise each
+// non-blank line is an event, so one bad line doesn't affect the others.
+func readEvents(body *bufio.Reader) ([]json.RawMessage, error) {
+	events := make([]json.RawMessage, 0)
+	for {
+		b, err := body.Peek(1)
+		if err == io.EOF {
+			return events, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if b[0] != ' ' && b[0] != '\t' && b[0] != '\r' && b[0] != '\n' {
+			break
+		}
+		body.ReadByte()
+	}
+
+	if b, _ := body.Peek(1); b[0] == '[' {
+		if err := json.NewDecoder(body).Decode(&events); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxEventsBody)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			events = append(events, json.RawMessage(append([]byte(nil), line...)))
+		}
+	}
+	return events, scanner.Err()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/jbwyme/gofigure"
+	"html"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+var store gofigure.Store
+var writer *gofigure.Writer
+
+// querySlots bounds how many queries run at once. Requests beyond that wait
+// for a slot until their client goes away.
+var querySlots chan struct{}
+
+// scanWorkers is how many files or chunks each query scans at once.
+var scanWorkers int
+
+// memoryLimit and tempDir bound the memory each query's REDUCE groups take,
+// and say where what doesn't fit is spilled.
+var memoryLimit int64
+var tempDir string
+
+// maxTimeout caps how long a query may run, whatever timeout it asks for.
+// Zero means no cap.
+var maxTimeout time.Duration
+
+func main() {
+	addrPtr := flag.String("addr", ":8080", "Address to listen on")
+	dirPtr := flag.String("dir", "data", "Directory holding the daily event files")
+	workersPtr := flag.Int("workers", runtime.NumCPU(), "Maximum number of queries to run at once")
+	flag.IntVar(&scanWorkers, "scan-workers", runtime.NumCPU(), "Number of files or chunks of files each query scans at once")
+	flag.Int64Var(&memoryLimit, "memory-limit", 1024, "Megabytes of REDUCE groups each query holds in memory before spilling to disk. 0 for no limit")
+	flag.StringVar(&tempDir, "tmp-dir", "", "Directory for spill files. Defaults to the system's temporary directory")
+	flag.DurationVar(&maxTimeout, "max-timeout", 5*time.Minute, "Longest a query may run, or 0 for no limit")
+	flag.Parse()
+
+	store = gofigure.DirStore{Dir: *dirPtr}
+	writer = &gofigure.Writer{Dir: *dirPtr}
+	querySlots = make(chan struct{}, *workersPtr)
+
+	router := mux.NewRouter().StrictSlash(true)
+	router.HandleFunc("/", Index)
+	router.HandleFunc("/write", Write)
+	router.HandleFunc("/query", Query)
+	router.HandleFunc("/events", Events).Methods("POST")
+	log.Fatal(http.ListenAndServe(*addrPtr, router))
+}
+
+func Index(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "Hello, %q", html.EscapeString(r.URL.Path))
+}
+
+func Write(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	data := r.URL.Query().Get("data")
+	if data == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParam, "'data' param required", nil)
+		return
+	}
+	if err := writer.WriteJSON(data); err != nil {
+		if errors.Is(err, gofigure.ErrInvalidEvent) {
+			writeError(w, http.StatusBadRequest, codeInvalidEvent, err.Error(), err)
+		} else {
+			log.Println(err)
+			writeError(w, http.StatusInternalServerError, codeInternal, "failed to write events", nil)
+		}
+		return
+	}
+	fmt.Fprintf(w, "1")
+}
+
+func Query(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	params := r.URL.Query()
+	if params.Get("query") == "" {
+		writeError(w, http.StatusBadRequest, codeMissingParam, "'query' param required", nil)
+		return
+	}
+
+	tr := gofigure.TimeRange{Start: time.Unix(0, 0), End: time.Now()}
+	if start := params.Get("start"); start != "" {
+		if secs, err := strconv.ParseInt(start, 10, 64); err == nil {
+			tr.Start = time.Unix(secs, 0)
+		} else {
+			writeError(w, http.StatusBadRequest, codeInvalidParam, "'start' must be a unix timestamp in seconds", nil)
+			return
+		}
+	}
+	if end := params.Get("end"); end != "" {
+		if secs, err := strconv.ParseInt(end, 10, 64); err == nil {
+			tr.End = time.Unix(secs, 0)
+		} else {
+			writeError(w, http.StatusBadRequest, codeInvalidParam, "'end' must be a unix timestamp in seconds", nil)
+			return
+		}
+	}
+
+	engine := &gofigure.Engine{Workers: scanWorkers, MemoryLimit: memoryLimit << 20, TempDir: tempDir}
+	if tz := params.Get("tz"); tz != "" {
+		if loc, err := time.LoadLocation(tz); err == nil {
+			engine.Location = loc
+		} else {
+			writeError(w, http.StatusBadRequest, codeInvalidParam, "'tz' is not a known timezone: "+tz, nil)
+			return
+		}
+	}
+
+	timeout := maxTimeout
+	if t := params.Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, codeInvalidParam, "'timeout' must be a positive duration such as 30s", nil)
+			return
+		}
+		if timeout == 0 || d < timeout {
+			timeout = d
+		}
+	}
+
+	q, err := gofigure.Parse(params.Get("query"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, codeParseError, err.Error(), err)
+		return
+	}
+
+	select {
+	case querySlots <- struct{}{}:
+		defer func() { <-querySlots }()
+	case <-r.Context().Done():
+		return
+	}
+
+	// The query stops when the client disconnects, as well as on timeout.
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	result, err := engine.Execute(ctx, store, q, tr)
+	if err != nil {
+		log.Println(err)
+		var canceled *gofigure.CanceledError
+		if errors.As(err, &canceled) && errors.Is(err, context.DeadlineExceeded) {
+			writeError(w, http.StatusGatewayTimeout, codeQueryTimeout, err.Error(), err)
+		} else if errors.As(err, &canceled) {
+			// The client has gone, there's no one to answer.
+			return
+		} else {
+			writeError(w, http.StatusInternalServerError, codeInternal, "query failed", nil)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+// Go provides a `flag` package supporting basic
+// command-line flag parsing. We'll use this package to
+// implement our example command-line program.
+import "flag"
+import "fmt"
+import "os"
+import "github.com/jbwyme/gofigure"
+
+func main() {
+	dataPtr := flag.String("data", "", "the data to write")
+	dirPtr := flag.String("dir", "data", "Directory holding the daily event files")
+	flag.Parse()
+
+	writer := &gofigure.Writer{Dir: *dirPtr}
+	if err := writer.WriteJSON(*dataPtr); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
@@ -1,6 +1,9 @@
-package main
+package gofigure
 
-import "strconv"
+import (
+    "strconv"
+    "strings"
+)
 
 func compareIntToInt(left int, right int, op Token) bool {
     switch(op) {
@@ -99,4 +102,94 @@ func compareStringToFloat(left string, right float64, op Token) bool {
     }
 } 
 
+// Booleans are only equal or not equal, they have no order.
+func compareBoolToBool(left bool, right bool, op Token) bool {
+    switch(op) {
+    case EQ:
+        return left == right
+    case NOT_EQ:
+        return left != right
+    default:
+        return false
+    }
+}
+
+func compareBoolToString(left bool, right string, op Token) bool {
+    if rightBool, err := strconv.ParseBool(right); err == nil {
+        return compareBoolToBool(left, rightBool, op)
+    } else {
+        return false
+    }
+}
+
+func compareStringToBool(left string, right bool, op Token) bool {
+    if leftBool, err := strconv.ParseBool(left); err == nil {
+        return compareBoolToBool(leftBool, right, op)
+    } else {
+        return false
+    }
+}
+
+// compareNulls compares against a null literal, given which sides are null.
+// "x = null" holds only when x is null or missing and "x != null" only when
+// it isn't. Null has no order, so other operators never hold.
+func compareNulls(leftNil bool, rightNil bool, op Token) bool {
+    switch(op) {
+    case EQ:
+        return leftNil && rightNil
+    case NOT_EQ:
+        return !(leftNil && rightNil)
+    default:
+        return false
+    }
+}
 
+
+
+// typeRank orders values of different types when sorting: nil, booleans,
+// numbers, strings, then everything else.
+func typeRank(v interface{}) int {
+    switch v.(type) {
+    case nil:
+        return 0
+    case bool:
+        return 1
+    case int, float64:
+        return 2
+    case string:
+        return 3
+    default:
+        return 4
+    }
+}
+
+// compareValues returns -1, 0 or 1 as left sorts before, with or after right.
+func compareValues(left interface{}, right interface{}) int {
+    if lr, rr := typeRank(left), typeRank(right); lr != rr {
+        if lr < rr {
+            return -1
+        }
+        return 1
+    }
+    switch l := left.(type) {
+    case bool:
+        if r := right.(bool); l == r {
+            return 0
+        } else if r {
+            return -1
+        }
+        return 1
+    case int, float64:
+        lf, _ := toFloat(l)
+        rf, _ := toFloat(right)
+        if lf < rf {
+            return -1
+        } else if lf > rf {
+            return 1
+        }
+        return 0
+    case string:
+        return strings.Compare(l, right.(string))
+    }
+    return 0
+}
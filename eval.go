@@ -0,0 +1,357 @@
+package gofigure
+
+import (
+	"strconv"
+	"time"
+)
+
+// env holds the per-execution settings expressions are evaluated with.
+type env struct {
+	// loc is the timezone time bucketing functions truncate in.
+	loc *time.Location
+}
+
+func pluck(prop string, collection []interface{}) []interface{} {
+	var res []interface{} = make([]interface{}, 0)
+	for _, entry := range collection {
+		if mapVal, ok := entry.(map[string]interface{}); ok {
+			if val, ok := lookup(mapVal, prop); ok {
+				res = append(res, val)
+			}
+		}
+	}
+	return res
+}
+
+// truth is the result of a condition under SQL's three-valued logic.
+type truth int
+
+const (
+	truthFalse truth = iota
+	truthTrue
+	// truthUnknown results from comparing a null or missing value.
+	truthUnknown
+)
+
+func toTruth(b bool) truth {
+	if b {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+// _eval evaluates a comparison. Comparing a null or missing value is
+// unknown, except against the null literal, where "= null" and "!= null"
+// test for null.
+func _eval(e *env, event map[string]interface{}, condition Condition) truth {
+	if isNullLiteral(condition.left) || isNullLiteral(condition.right) {
+		leftNil := evalOperand(e, event, condition.left).GetType() == TYPE_NIL
+		rightNil := evalOperand(e, event, condition.right).GetType() == TYPE_NIL
+		return toTruth(compareNulls(leftNil, rightNil, condition.op))
+	}
+
+	l := evalOperand(e, event, condition.left).(*Field)
+	r := evalOperand(e, event, condition.right).(*Field)
+	if l.Type == TYPE_NIL || r.Type == TYPE_NIL {
+		return truthUnknown
+	}
+	return toTruth(compareFields(l, r, condition.op))
+}
+
+// compareFields compares two non-null fields.
+func compareFields(l *Field, r *Field, op Token) bool {
+	switch l.GetType() {
+	case TYPE_INT:
+		left := l.IntVal
+		switch r.Type {
+		case TYPE_INT:
+			right := r.IntVal
+			return compareIntToInt(left, right, op)
+		case TYPE_FLOAT:
+			right := r.FloatVal
+			return compareIntToFloat(left, right, op)
+		case TYPE_STRING:
+			right := r.StringVal
+			return compareIntToString(left, right, op)
+		}
+	case TYPE_FLOAT:
+		left := l.FloatVal
+		switch r.Type {
+		case TYPE_INT:
+			right := r.IntVal
+			return compareFloatToInt(left, right, op)
+		case TYPE_FLOAT:
+			right := r.FloatVal
+			return compareFloatToFloat(left, right, op)
+		case TYPE_STRING:
+			right := r.StringVal
+			return compareFloatToString(left, right, op)
+		}
+	case TYPE_STRING:
+		left := l.StringVal
+		switch r.Type {
+		case TYPE_INT:
+			right := r.IntVal
+			return compareStringToInt(left, right, op)
+		case TYPE_FLOAT:
+			right := r.FloatVal
+			return compareStringToFloat(left, right, op)
+		case TYPE_STRING:
+			right := r.StringVal
+			return compareStringToString(left, right, op)
+		case TYPE_BOOL:
+			right := r.BoolVal
+			return compareStringToBool(left, right, op)
+		}
+	case TYPE_BOOL:
+		left := l.BoolVal
+		switch r.Type {
+		case TYPE_STRING:
+			right := r.StringVal
+			return compareBoolToString(left, right, op)
+		case TYPE_BOOL:
+			right := r.BoolVal
+			return compareBoolToBool(left, right, op)
+		}
+	}
+	// Values of other types, such as lists, never match.
+	return false
+}
+
+// isNullLiteral returns true if node is the literal null.
+func isNullLiteral(node IField) bool {
+	f, ok := node.(*Field)
+	return ok && f.Type == TYPE_NIL
+}
+
+// evalCondition reports whether a WHERE expression tree holds for a row.
+// Rows for which it is unknown don't match.
+func evalCondition(e *env, row map[string]interface{}, condition ICondition) bool {
+	return evalTruth(e, row, condition) == truthTrue
+}
+
+// evalTruth evaluates a WHERE expression tree against a row.
+func evalTruth(e *env, row map[string]interface{}, condition ICondition) truth {
+	if c, ok := condition.(*Condition); ok {
+		return _eval(e, row, *c)
+	} else if c, ok := condition.(*LogicalCondition); ok {
+		left := evalTruth(e, row, c.Left)
+		switch c.Operator {
+		case AND:
+			if left == truthFalse {
+				return truthFalse
+			} else if right := evalTruth(e, row, c.Right); right == truthFalse {
+				return truthFalse
+			} else if left == truthUnknown || right == truthUnknown {
+				return truthUnknown
+			}
+			return truthTrue
+		case OR:
+			if left == truthTrue {
+				return truthTrue
+			} else if right := evalTruth(e, row, c.Right); right == truthTrue {
+				return truthTrue
+			} else if left == truthUnknown || right == truthUnknown {
+				return truthUnknown
+			}
+			return truthFalse
+		}
+	} else if c, ok := condition.(*NotCondition); ok {
+		switch evalTruth(e, row, c.Operand) {
+		case truthTrue:
+			return truthFalse
+		case truthFalse:
+			return truthTrue
+		}
+		return truthUnknown
+	} else if c, ok := condition.(*IsNullCondition); ok {
+		isNull := evalOperand(e, row, c.Operand).GetType() == TYPE_NIL
+		return toTruth(isNull != c.Not)
+	} else if c, ok := condition.(*InCondition); ok {
+		in := evalIn(e, row, c)
+		if c.Not && in != truthUnknown {
+			return toTruth(in == truthFalse)
+		}
+		return in
+	} else if c, ok := condition.(*MatchCondition); ok {
+		v := evalField(e, row, c.Value)
+		s, ok := toString(v)
+		if v == nil {
+			return truthUnknown
+		} else if !ok {
+			return truthFalse
+		}
+		return toTruth(c.re.MatchString(s) != c.Not)
+	} else if c, ok := condition.(*ExistsCondition); ok {
+		_, ok := lookup(row, c.Property)
+		return toTruth(ok)
+	}
+	return truthFalse
+}
+
+// setKey returns the key a value is hashed under for IN and REDUCE groups,
+// so that numbers match regardless of int or float type but not strings of
+// digits. Null has no key.
+func setKey(v interface{}) (string, bool) {
+	if v == nil {
+		return "", false
+	} else if f, ok := toFloat(v); ok {
+		return "n:" + strconv.FormatFloat(f, 'g', -1, 64), true
+	} else if s, ok := v.(string); ok {
+		return "s:" + s, true
+	} else if b, ok := v.(bool); ok {
+		return "b:" + strconv.FormatBool(b), true
+	}
+	return "", false
+}
+
+// evalIn tests whether the value of c.Value is in c.Set. As in SQL, a null
+// value, or a value not found in a set holding a null, is unknown.
+func evalIn(e *env, row map[string]interface{}, c *InCondition) truth {
+	key, ok := setKey(evalField(e, row, c.Value))
+	if !ok {
+		return truthUnknown
+	}
+
+	if list, ok := c.Set.(*ListLiteral); ok {
+		if list.set[key] {
+			return truthTrue
+		} else if list.hasNull {
+			return truthUnknown
+		}
+		return truthFalse
+	}
+
+	set := evalField(e, row, c.Set)
+	collection, ok := set.([]interface{})
+	if set == nil {
+		return truthUnknown
+	} else if !ok {
+		return truthFalse
+	}
+	hasNull := false
+	for _, item := range collection {
+		if k, ok := setKey(item); ok && k == key {
+			return truthTrue
+		} else if item == nil {
+			hasNull = true
+		}
+	}
+	if hasNull {
+		return truthUnknown
+	}
+	return truthFalse
+}
+
+// evalOperand resolves one side of a condition to a typed Field. Literals
+// are returned as is, properties and expressions are evaluated on event.
+func evalOperand(e *env, event map[string]interface{}, node IField) IField {
+	if f, ok := node.(*Field); ok {
+		if f.Type == TYPE_PROPERTY {
+			return evalPropertyNode(event, f)
+		}
+		return f
+	}
+	return valueToField(evalField(e, event, node))
+}
+
+// could probably remove this in favor of evalField
+func evalPropertyNode(event map[string]interface{}, f *Field) *Field {
+	val, _ := lookup(event, f.StringVal)
+	return valueToField(val)
+}
+
+// valueToField wraps a decoded event value in a typed Field.
+func valueToField(val interface{}) *Field {
+	if val == nil {
+		return &Field{Type: TYPE_NIL}
+	} else if intVal, ok := val.(int); ok {
+		return &Field{Type: TYPE_INT, IntVal: intVal}
+	} else if floatVal, ok := val.(float64); ok {
+		return &Field{Type: TYPE_FLOAT, FloatVal: floatVal}
+	} else if strVal, ok := val.(string); ok {
+		return &Field{Type: TYPE_STRING, StringVal: strVal}
+	} else if boolVal, ok := val.(bool); ok {
+		return &Field{Type: TYPE_BOOL, BoolVal: boolVal}
+	} else if listVal, ok := val.([]interface{}); ok {
+		return &Field{Type: TYPE_LIST, ListVal: listVal}
+	} else {
+		return &Field{}
+	}
+}
+
+func evalField(e *env, event_json map[string]interface{}, field IField) interface{} {
+	if f, ok := field.(*Field); ok {
+		if f.Type != TYPE_PROPERTY {
+			return literalValue(f)
+		} else if val, ok := lookup(event_json, f.StringVal); ok {
+			return val
+		} else {
+			// fmt.Printf("No field %s in row %s\n", f.StringVal, event_json)
+			return nil
+		}
+	} else if itr, ok := field.(*FieldItr); ok {
+		if collection, ok := evalField(e, event_json, itr.Collection).([]interface{}); ok {
+			return pluck(itr.StringVal, collection)
+		}
+	} else if exp, ok := field.(*BinaryExpr); ok {
+		left, lok := toFloat(evalField(e, event_json, exp.Left))
+		right, rok := toFloat(evalField(e, event_json, exp.Right))
+		if lok && rok {
+			return arithmetic(exp.Operator, left, right)
+		}
+	} else if neg, ok := field.(*UnaryExpr); ok {
+		if operand, ok := toFloat(evalField(e, event_json, neg.Operand)); ok {
+			return arithmetic(SUBTRACT, 0, operand)
+		}
+	} else if call, ok := field.(*FuncCall); ok {
+		args := make([]interface{}, len(call.Args))
+		for i, arg := range call.Args {
+			args[i] = evalField(e, event_json, arg)
+		}
+		return functions[call.Func].eval(e, args)
+	} else if agg, ok := field.(*Aggregator); ok {
+		if collection, ok := evalField(e, event_json, agg.Target).([]interface{}); ok {
+			return aggregate(agg.Method, collection)
+		} else {
+			// fmt.Printf("Can't aggregate %s because it's not a list. val: %s\n", agg.Target.GetName(), event_json)
+		}
+	}
+	return nil
+}
+
+// literalValue returns the value of a literal field.
+func literalValue(f *Field) interface{} {
+	switch f.Type {
+	case TYPE_INT:
+		return f.IntVal
+	case TYPE_FLOAT:
+		return f.FloatVal
+	case TYPE_STRING:
+		return f.StringVal
+	case TYPE_DURATION:
+		return f.IntVal
+	case TYPE_BOOL:
+		return f.BoolVal
+	}
+	return nil
+}
+
+// arithmetic applies an arithmetic operator. Division by zero yields nil
+// rather than an infinity, so it serializes as null.
+func arithmetic(op Token, left float64, right float64) interface{} {
+	switch op {
+	case ADD:
+		return left + right
+	case SUBTRACT:
+		return left - right
+	case MULTIPLY:
+		return left * right
+	case DIVIDE:
+		if right == 0 {
+			return nil
+		}
+		return left / right
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package gofigure
+
+import "strings"
+
+// Plan describes how a query would run, as returned for EXPLAIN queries.
+type Plan struct {
+	Map    *StatementPlan `json:"map"`
+	Reduce *StatementPlan `json:"reduce,omitempty"`
+	// Start and End are the time range in unix seconds, End exclusive.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Files are the files the time range selects, in scan order.
+	Files   []string `json:"files"`
+	Workers int      `json:"workers"`
+}
+
+// StatementPlan describes a MAP or REDUCE statement in query syntax.
+type StatementPlan struct {
+	Fields  []string `json:"fields"`
+	Where   string   `json:"where,omitempty"`
+	Keys    []string `json:"keys,omitempty"`
+	Having  string   `json:"having,omitempty"`
+	OrderBy []string `json:"order_by,omitempty"`
+	Limit   int      `json:"limit,omitempty"`
+}
+
+func newPlan(q *Query, tr TimeRange, files []string, workers int) *Plan {
+	plan := &Plan{
+		Map:     statementPlan(q.Map),
+		Start:   tr.Start.Unix(),
+		End:     tr.End.Unix(),
+		Files:   files,
+		Workers: workers,
+	}
+	if q.Reduce != nil {
+		plan.Reduce = statementPlan(&q.Reduce.Statement)
+		plan.Reduce.Keys = fieldStrings(q.Reduce.Keys)
+		if q.Reduce.Having != nil {
+			// Once resolved, aggregates in HAVING read hidden columns named
+			// after them, prefixed with a NUL.
+			plan.Reduce.Having = strings.Replace(conditionString(q.Reduce.Having), "\x00", "", -1)
+		}
+	}
+	return plan
+}
+
+func statementPlan(s *Statement) *StatementPlan {
+	plan := &StatementPlan{Fields: fieldStrings(s.Fields), Limit: s.Limit}
+	if s.Condition != nil {
+		plan.Where = conditionString(s.Condition)
+	}
+	for _, o := range s.OrderBy {
+		term := exprString(o.Field)
+		if o.Desc {
+			term += " DESC"
+		}
+		plan.OrderBy = append(plan.OrderBy, term)
+	}
+	return plan
+}
+
+// fieldStrings renders fields in query syntax, with their aliases.
+func fieldStrings(fields []IField) []string {
+	res := make([]string, len(fields))
+	for i, f := range fields {
+		res[i] = exprString(f)
+		if name := f.GetName(); name != res[i] {
+			res[i] += " AS " + name
+		}
+	}
+	return res
+}
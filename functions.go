@@ -0,0 +1,158 @@
+package gofigure
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFilledBuckets caps how many empty buckets gap-filling will add, so a
+// fine bucket over a long range can't blow up the result.
+const maxFilledBuckets = 100000
+
+// function is a scalar function callable from a query.
+type function struct {
+	minArgs int
+	maxArgs int
+	// check validates the arguments at parse time. May be nil.
+	check func(args []IField) error
+	eval  func(e *env, args []interface{}) interface{}
+	// bucket returns the time bucket the function truncates to, for
+	// gap-filling REDUCE results. Nil for non time bucketing functions.
+	bucket func(args []IField) *timeBucket
+}
+
+var functions = map[string]function{
+	"hour":  timeBucketFunction("hour"),
+	"day":   timeBucketFunction("day"),
+	"week":  timeBucketFunction("week"),
+	"month": timeBucketFunction("month"),
+	"bucket": {
+		minArgs: 2,
+		maxArgs: 2,
+		check: func(args []IField) error {
+			if f, ok := args[1].(*Field); !ok || f.Type != TYPE_DURATION || f.IntVal <= 0 {
+				return fmt.Errorf("bucket expects a duration such as 15m as its second argument")
+			}
+			return nil
+		},
+		eval: func(e *env, args []interface{}) interface{} {
+			size, _ := args[1].(int)
+			return (&timeBucket{unit: "second", size: size}).floorValue(e.loc, args[0])
+		},
+		bucket: func(args []IField) *timeBucket {
+			return &timeBucket{unit: "second", size: args[1].(*Field).IntVal}
+		},
+	},
+	"lower":    stringFunction(strings.ToLower),
+	"upper":    stringFunction(strings.ToUpper),
+	"substr":   substrFunction,
+	"split":    splitFunction,
+	"concat":   concatFunction,
+	"length":   lengthFunction,
+	"url_host": urlFunction(urlHost),
+	"url_path": urlFunction(urlPath),
+}
+
+func timeBucketFunction(unit string) function {
+	b := &timeBucket{unit: unit, size: 1}
+	return function{
+		minArgs: 1,
+		maxArgs: 1,
+		eval: func(e *env, args []interface{}) interface{} {
+			return b.floorValue(e.loc, args[0])
+		},
+		bucket: func(args []IField) *timeBucket {
+			return b
+		},
+	}
+}
+
+// timeBucket truncates unix timestamps to the start of an hour, day, week
+// (starting Monday), month or a number of seconds, in the timestamp's
+// location.
+type timeBucket struct {
+	unit string
+	size int
+}
+
+// floorValue truncates a timestamp in seconds in loc, returning nil for
+// values that aren't numbers.
+func (b *timeBucket) floorValue(loc *time.Location, v interface{}) interface{} {
+	if ts, ok := toFloat(v); ok {
+		return float64(b.floor(time.Unix(int64(ts), 0).In(loc)).Unix())
+	}
+	return nil
+}
+
+func (b *timeBucket) floor(t time.Time) time.Time {
+	size := int64(b.size)
+	switch b.unit {
+	case "hour":
+		// Hours are floored like fixed size buckets, as the local hour
+		// repeats across a DST fall-back and time.Date would pick the
+		// first of the two.
+		size = 3600
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "week":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	// Align fixed size buckets to local midnights rather than to the epoch.
+	_, offset := t.Zone()
+	local := t.Unix() + int64(offset)
+	local -= ((local % size) + size) % size
+	return time.Unix(local-int64(offset), 0).In(t.Location())
+}
+
+// next returns the start of the bucket after the one starting at t, which is
+// always later than t.
+func (b *timeBucket) next(t time.Time) time.Time {
+	switch b.unit {
+	case "hour":
+		return b.floor(t.Add(time.Hour))
+	case "day":
+		return t.AddDate(0, 0, 1)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	}
+	return b.floor(t.Add(time.Duration(b.size) * time.Second))
+}
+
+// parseDuration parses a duration literal such as 30s, 15m, 6h, 1d or 2w
+// into seconds.
+func parseDuration(lit string) (int, error) {
+	units := map[byte]int{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+	if len(lit) < 2 {
+		return 0, fmt.Errorf("invalid duration %q", lit)
+	}
+	unit, ok := units[lit[len(lit)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid duration %q", lit)
+	}
+	n, err := strconv.Atoi(lit[:len(lit)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", lit)
+	}
+	return n * unit, nil
+}
+
+// formatDuration renders seconds as a duration literal in the largest unit
+// that divides it.
+func formatDuration(secs int) string {
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"w", 604800}, {"d", 86400}, {"h", 3600}, {"m", 60}} {
+		if secs != 0 && secs%u.size == 0 {
+			return strconv.Itoa(secs/u.size) + u.suffix
+		}
+	}
+	return strconv.Itoa(secs) + "s"
+}
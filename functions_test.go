@@ -0,0 +1,142 @@
+package gofigure
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeBucketFloor(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		loc  *time.Location
+		b    *timeBucket
+		ts   string
+		want string
+	}{
+		{time.UTC, &timeBucket{unit: "hour", size: 1}, "2023-11-05T04:30:00Z", "2023-11-05T04:00:00Z"},
+		{time.UTC, &timeBucket{unit: "day", size: 1}, "2023-11-05T04:30:00Z", "2023-11-05T00:00:00Z"},
+		{time.UTC, &timeBucket{unit: "week", size: 1}, "2023-11-05T04:30:00Z", "2023-10-30T00:00:00Z"},
+		{time.UTC, &timeBucket{unit: "month", size: 1}, "2023-11-05T04:30:00Z", "2023-11-01T00:00:00Z"},
+		{time.UTC, &timeBucket{unit: "second", size: 900}, "2023-11-05T04:31:00Z", "2023-11-05T04:30:00Z"},
+		// 01:30 EDT and 01:30 EST are different hours.
+		{ny, &timeBucket{unit: "hour", size: 1}, "2023-11-05T05:30:00Z", "2023-11-05T05:00:00Z"},
+		{ny, &timeBucket{unit: "hour", size: 1}, "2023-11-05T06:30:00Z", "2023-11-05T06:00:00Z"},
+		{ny, &timeBucket{unit: "day", size: 1}, "2023-11-05T06:30:00Z", "2023-11-05T04:00:00Z"},
+		{ny, &timeBucket{unit: "second", size: 86400}, "2023-11-06T06:30:00Z", "2023-11-06T05:00:00Z"},
+	}
+	for _, test := range tests {
+		ts, _ := time.Parse(time.RFC3339, test.ts)
+		want, _ := time.Parse(time.RFC3339, test.want)
+		if got := test.b.floorValue(test.loc, float64(ts.Unix())); got != float64(want.Unix()) {
+			t.Errorf("%s %s in %s: got %v, want %s", test.b.unit, test.ts, test.loc, got, test.want)
+		}
+	}
+}
+
+func TestTimeBucketNext(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	// Step across both DST changes of 2023 and check every bucket starts
+	// where the previous one ended.
+	start, _ := time.Parse(time.RFC3339, "2023-03-10T00:00:00Z")
+	end, _ := time.Parse(time.RFC3339, "2023-11-10T00:00:00Z")
+	for _, b := range []*timeBucket{
+		{unit: "hour", size: 1},
+		{unit: "day", size: 1},
+		{unit: "week", size: 1},
+		{unit: "month", size: 1},
+		{unit: "second", size: 900},
+		{unit: "second", size: 3600},
+	} {
+		bucket := b.floor(start.In(ny))
+		for bucket.Before(end) {
+			next := b.next(bucket)
+			if !next.After(bucket) {
+				t.Fatalf("%s %d: next(%v) = %v", b.unit, b.size, bucket, next)
+			}
+			if got := b.floor(next.Add(-time.Second)); !got.Equal(bucket) {
+				t.Fatalf("%s %d: bucket before %v starts at %v, want %v", b.unit, b.size, next, got, bucket)
+			}
+			bucket = next
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		lit  string
+		want int
+	}{
+		{"30s", 30},
+		{"15m", 900},
+		{"6h", 21600},
+		{"1d", 86400},
+		{"2w", 1209600},
+	}
+	for _, test := range tests {
+		if got, err := parseDuration(test.lit); err != nil || got != test.want {
+			t.Errorf("%s: got %d, %v, want %d", test.lit, got, err, test.want)
+		}
+		if got := formatDuration(test.want); got != test.lit {
+			t.Errorf("formatDuration(%d): got %s, want %s", test.want, got, test.lit)
+		}
+	}
+	for _, lit := range []string{"", "s", "5", "5y", "xs"} {
+		if _, err := parseDuration(lit); err == nil {
+			t.Errorf("%s: expected an error", lit)
+		}
+	}
+}
+
+func TestStringFunctions(t *testing.T) {
+	row := map[string]interface{}{
+		"s":    "Hello, Wörld",
+		"url":  "https://www.example.com:8080/a/b?q=1#f",
+		"bare": "example.com/x",
+		"tags": []interface{}{"a", "b"},
+		"n":    3.0,
+	}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"lower(s)", "hello, wörld"},
+		{"upper(s)", "HELLO, WÖRLD"},
+		{"substr(s, 8)", "Wörld"},
+		{"substr(s, 8, 2)", "Wö"},
+		{"substr(s, 0, 3)", "He"},
+		{"substr(s, 20)", ""},
+		{`split(s, ", ", 1)`, "Wörld"},
+		{`split(s, ", ", -2)`, "Hello"},
+		{`split(s, ", ", 2)`, nil},
+		{`length(split(s, ","))`, 2},
+		{`concat("n=", n, ", ", missing, true)`, "n=3, true"},
+		{"length(s)", 12},
+		{"length(tags)", 2},
+		{"length(n)", nil},
+		{"url_host(url)", "www.example.com"},
+		{"url_path(url)", "/a/b"},
+		{"url_host(bare)", "example.com"},
+		{"url_path(bare)", "/x"},
+		{`url_path("https://example.com")`, "/"},
+		{"lower(missing)", nil},
+		{"upper(n)", nil},
+	}
+	for _, test := range tests {
+		if got := evalField(testEnv, row, parseExprField(t, test.expr)); got != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.expr, got, test.want)
+		}
+	}
+
+	for _, query := range []string{"MAP lower()", "MAP lower(a, b)", "MAP concat()", "MAP substr(a)"} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/jbwyme/gofigure
+
+go 1.19
+
+require (
+	github.com/bitly/go-simplejson v0.5.1
+	github.com/gorilla/mux v1.8.1
+)
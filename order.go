@@ -0,0 +1,100 @@
+package gofigure
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// OrderBy is a single term of an ORDER BY clause.
+type OrderBy struct {
+	Field IField
+	Desc  bool
+}
+
+type sortedRow struct {
+	row  map[string]interface{}
+	keys []interface{}
+	seq  int
+}
+
+// rowSorter collects output rows in ORDER BY order. With a limit it keeps
+// only the best rows seen so far in a heap whose root is the worst of them,
+// so memory is bounded by the limit rather than by the number of rows.
+// Rows that compare equal keep the order they were added in.
+type rowSorter struct {
+	env   *env
+	order []OrderBy
+	limit int
+	rows  []*sortedRow
+	seq   int
+}
+
+func newRowSorter(e *env, order []OrderBy, limit int) *rowSorter {
+	return &rowSorter{env: e, order: order, limit: limit, rows: make([]*sortedRow, 0)}
+}
+
+// before reports whether a sorts before b in the output.
+func (s *rowSorter) before(a *sortedRow, b *sortedRow) bool {
+	for i, o := range s.order {
+		if c := compareValues(a.keys[i], b.keys[i]); c != 0 {
+			return (c < 0) != o.Desc
+		}
+	}
+	return a.seq < b.seq
+}
+
+// Add offers a row to the sorter.
+func (s *rowSorter) Add(row map[string]interface{}) {
+	r := &sortedRow{row: row, keys: make([]interface{}, len(s.order))}
+	for i, o := range s.order {
+		r.keys[i] = evalField(s.env, row, o.Field)
+	}
+	s.add(r)
+}
+
+// merge adds the rows kept by other, a sorter over the rows that follow the
+// ones added to s, as if they had been added to s.
+func (s *rowSorter) merge(other *rowSorter) {
+	sort.Slice(other.rows, func(i, j int) bool { return other.rows[i].seq < other.rows[j].seq })
+	for _, r := range other.rows {
+		s.add(r)
+	}
+}
+
+func (s *rowSorter) add(r *sortedRow) {
+	r.seq = s.seq
+	s.seq++
+	if s.limit <= 0 {
+		s.rows = append(s.rows, r)
+	} else if len(s.rows) < s.limit {
+		heap.Push(s, r)
+	} else if s.before(r, s.rows[0]) {
+		s.rows[0] = r
+		heap.Fix(s, 0)
+	}
+}
+
+// Rows returns the collected rows in order.
+func (s *rowSorter) Rows() []map[string]interface{} {
+	sort.Slice(s.rows, func(i, j int) bool { return s.before(s.rows[i], s.rows[j]) })
+	res := make([]map[string]interface{}, len(s.rows))
+	for i, r := range s.rows {
+		res[i] = r.row
+	}
+	return res
+}
+
+// heap.Interface, ordered so the root is the row that sorts last.
+func (s *rowSorter) Len() int           { return len(s.rows) }
+func (s *rowSorter) Less(i, j int) bool { return s.before(s.rows[j], s.rows[i]) }
+func (s *rowSorter) Swap(i, j int)      { s.rows[i], s.rows[j] = s.rows[j], s.rows[i] }
+
+func (s *rowSorter) Push(x interface{}) {
+	s.rows = append(s.rows, x.(*sortedRow))
+}
+
+func (s *rowSorter) Pop() interface{} {
+	last := s.rows[len(s.rows)-1]
+	s.rows = s.rows[:len(s.rows)-1]
+	return last
+}
@@ -1,10 +1,13 @@
-package main
+package gofigure
 
 import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
 )
 
 type ItrOperator string
@@ -16,16 +19,75 @@ const (
 type AggregateMethod string
 
 const (
-	AGG_SUM   = "SUM"
-	AGG_COUNT = "COUNT"
+	AGG_SUM            = "SUM"
+	AGG_COUNT          = "COUNT"
+	AGG_AVG            = "AVG"
+	AGG_MIN            = "MIN"
+	AGG_MAX            = "MAX"
+	AGG_DISTINCT_COUNT = "DISTINCT_COUNT"
+	// AGG_APPROX_DISTINCT_COUNT estimates the distinct count with a
+	// HyperLogLog, to within about 1% using 16KB per group however many
+	// values it sees, where DISTINCT_COUNT holds every distinct value.
+	AGG_APPROX_DISTINCT_COUNT = "APPROX_DISTINCT_COUNT"
 )
 
+// aggregateMethods maps aggregate keyword tokens to their method.
+var aggregateMethods = map[Token]AggregateMethod{
+	SUM:                   AGG_SUM,
+	COUNT:                 AGG_COUNT,
+	AVG:                   AGG_AVG,
+	MIN:                   AGG_MIN,
+	MAX:                   AGG_MAX,
+	DISTINCT_COUNT:        AGG_DISTINCT_COUNT,
+	APPROX_DISTINCT_COUNT: AGG_APPROX_DISTINCT_COUNT,
+}
+
+// softKeywords are keywords only where the grammar expects them. Elsewhere
+// they are read as identifiers, so properties and aliases may be named after
+// them, as in "MAP order, max - min AS range".
+var softKeywords = map[Token]bool{
+	SUM:                   true,
+	COUNT:                 true,
+	AVG:                   true,
+	MIN:                   true,
+	MAX:                   true,
+	DISTINCT_COUNT:        true,
+	APPROX_DISTINCT_COUNT: true,
+	ORDER:                 true,
+	BY:                    true,
+	ASC:                   true,
+	DESC:                  true,
+	LIMIT:                 true,
+	IS:                    true,
+	EXISTS:                true,
+	LIKE:                  true,
+	ILIKE:                 true,
+	MATCHES:               true,
+	HAVING:                true,
+}
+
+// clauseKeywords are the soft keywords that may come right after an operand,
+// starting a clause or modifying the operand. An aggregate keyword followed
+// by one of them is read as a property, as in "ORDER BY count DESC".
+var clauseKeywords = map[Token]bool{
+	ORDER:   true,
+	ASC:     true,
+	DESC:    true,
+	LIMIT:   true,
+	IS:      true,
+	LIKE:    true,
+	ILIKE:   true,
+	MATCHES: true,
+	HAVING:  true,
+}
+
 type IField interface {
 	GetVal() interface{}
 	SetVal(v interface{})
 	GetType() Token
 	SetType(t Token)
 	GetName() string
+	SetName(n string)
 }
 
 type Field struct {
@@ -35,6 +97,7 @@ type Field struct {
 	IntVal    int
 	FloatVal  float64
 	StringVal string
+	BoolVal   bool
 	ListVal   []interface{}
 }
 
@@ -58,12 +121,26 @@ func (f *Field) GetName() string {
 	return f.Name
 }
 
+func (f *Field) SetName(n string) {
+	f.Name = n
+}
+
 type FieldItr struct {
 	Field
 	Operator   ItrOperator
 	Collection IField
 }
 
+// ListLiteral is a parenthesised list of literals, as in
+// event IN ("signup", "purchase"). Its values are hashed when it is parsed,
+// so membership tests don't depend on the length of the list.
+type ListLiteral struct {
+	Field
+	Items   []IField
+	set     map[string]bool
+	hasNull bool
+}
+
 type BinaryExpr struct {
 	Field
 	Left     IField
@@ -71,12 +148,98 @@ type BinaryExpr struct {
 	Right    IField
 }
 
+// UnaryExpr negates its operand.
+type UnaryExpr struct {
+	Field
+	Operand IField
+}
+
+// ICondition is a node in the boolean expression tree of a WHERE clause.
+type ICondition interface {
+	isCondition()
+}
+
+// FuncCall calls a scalar function such as day(_ts).
+type FuncCall struct {
+	Field
+	Func string
+	Args []IField
+}
+
+// Condition compares two fields with a comparison operator.
 type Condition struct {
 	left  IField
 	op    Token
 	right IField
 }
 
+func (c *Condition) isCondition() {}
+
+// LogicalCondition joins two conditions with AND or OR.
+type LogicalCondition struct {
+	Left     ICondition
+	Operator Token
+	Right    ICondition
+}
+
+func (c *LogicalCondition) isCondition() {}
+
+// NotCondition negates a condition.
+type NotCondition struct {
+	Operand ICondition
+}
+
+func (c *NotCondition) isCondition() {}
+
+// IsNullCondition tests whether a field is null or missing, or with Not
+// set, that it isn't.
+type IsNullCondition struct {
+	Operand IField
+	Not     bool
+}
+
+func (c *IsNullCondition) isCondition() {}
+
+// ExistsCondition tests whether an event has a property, even a null one.
+type ExistsCondition struct {
+	Property string
+}
+
+func (c *ExistsCondition) isCondition() {}
+
+// InCondition tests whether Value is one of the values of Set, which is a
+// ListLiteral or a list valued field, or with Not set, that it isn't.
+type InCondition struct {
+	Value IField
+	Set   IField
+	Not   bool
+}
+
+func (c *InCondition) isCondition() {}
+
+// MatchCondition matches a field's text against a LIKE, ILIKE or MATCHES
+// pattern, or with Not set, tests that it doesn't match. The pattern is
+// compiled when the query is parsed.
+type MatchCondition struct {
+	Value    IField
+	Operator Token
+	Pattern  string
+	Not      bool
+	re       *regexp.Regexp
+}
+
+func (c *MatchCondition) isCondition() {}
+
+// exprCondition is a bare expression found where a condition was expected.
+// It only exists while parsing, so that "(price - discount) > 5" can be told
+// apart from a parenthesised condition once the closing paren is reached.
+type exprCondition struct {
+	expr IField
+	end  Pos // position of the token after expr
+}
+
+func (c *exprCondition) isCondition() {}
+
 type Aggregator struct {
 	Field
 	Target IField
@@ -86,13 +249,15 @@ type Aggregator struct {
 type IStatement interface {
 	GetFields() []IField
 	AddField(f IField)
-	GetConditions() []Condition
-	AddCondition(c Condition)
+	GetCondition() ICondition
+	SetCondition(c ICondition)
 }
 
 type Statement struct {
-	Fields     []IField
-	Conditions []Condition
+	Fields    []IField
+	Condition ICondition
+	OrderBy   []OrderBy
+	Limit     int // 0 means no limit
 }
 
 func (s *Statement) GetFields() []IField {
@@ -106,17 +271,25 @@ func (s *Statement) AddField(f IField) {
 	s.Fields = append(s.Fields, f)
 }
 
-func (s *Statement) GetConditions() []Condition {
-	return s.Conditions
+func (s *Statement) GetCondition() ICondition {
+	return s.Condition
 }
 
-func (s *Statement) AddCondition(c Condition) {
-	s.Conditions = append(s.Conditions, c)
+func (s *Statement) SetCondition(c ICondition) {
+	s.Condition = c
 }
 
 type ReduceStatement struct {
 	Statement
-	Key string
+	Keys []IField
+	// Having filters the reduced groups. Once resolved it only reads REDUCE
+	// keys, REDUCE fields, _count and the results of aggs.
+	Having ICondition
+	// aggs are the distinct aggregates of the REDUCE fields and Having, each
+	// named after the hidden column its result is read from.
+	aggs []*Aggregator
+	// outputs are the REDUCE fields, resolved to read the results of aggs.
+	outputs []IField
 }
 
 type Parser struct {
@@ -124,144 +297,766 @@ type Parser struct {
 	buf struct {
 		tok Token  // last read token
 		lit string // last read literal
+		pos Pos    // position of the last read token
+		err string // scanner error for an ILLEGAL token
 		n   int    // buffer size (max=1)
 	}
+	// fieldPos is where each field and key starts, and havingPos where the
+	// REDUCE HAVING condition does, for errors found once the whole
+	// statement is parsed.
+	fieldPos  map[IField]Pos
+	havingPos Pos
+	// prefix is the EXPLAIN or ANALYZE the query started with, if any.
+	prefix string
+}
+
+// ParseError describes malformed query text and where it was found.
+type ParseError struct {
+	Pos
+	// Found is the offending token's text, or "end of query".
+	Found string
+	// Expected lists what would have been valid in place of Found, if known.
+	Expected []string
+	Msg      string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// Position returns the line and column the error was found at.
+func (e *ParseError) Position() (line, column int) {
+	return e.Line, e.Column
+}
+
+// tokenText describes a scanned token for error messages.
+func tokenText(tok Token, lit string) string {
+	if tok == EOF {
+		return "end of query"
+	} else if tok == STRING {
+		return strconv.Quote(strconv.Quote(lit))
+	}
+	return strconv.Quote(lit)
+}
+
+// expected returns an error for the last scanned token, which should have
+// been one of expected.
+func (p *Parser) expected(expected ...string) *ParseError {
+	found := tokenText(p.buf.tok, p.buf.lit)
+	if p.buf.tok == ILLEGAL && p.buf.err != "" {
+		return &ParseError{Pos: p.buf.pos, Found: found, Expected: expected, Msg: p.buf.err}
+	}
+	return &ParseError{
+		Pos:      p.buf.pos,
+		Found:    found,
+		Expected: expected,
+		Msg:      fmt.Sprintf("found %s, expected %s", found, oneOf(expected)),
+	}
+}
+
+// oneOf joins alternatives as "a, b or c".
+func oneOf(alts []string) string {
+	if len(alts) < 2 {
+		return strings.Join(alts, "")
+	}
+	return strings.Join(alts[:len(alts)-1], ", ") + " or " + alts[len(alts)-1]
+}
+
+// errorAt returns an error with message msg at pos.
+func (p *Parser) errorAt(pos Pos, msg string) *ParseError {
+	return &ParseError{Pos: pos, Msg: msg}
+}
+
+// peek returns the next non-whitespace token without consuming it.
+func (p *Parser) peek() Token {
+	tok, _ := p.scanIgnoreWhitespace()
+	p.unscan()
+	return tok
+}
+
+// nextPos returns the position of the next non-whitespace token without
+// consuming it.
+func (p *Parser) nextPos() Pos {
+	p.scanIgnoreWhitespace()
+	p.unscan()
+	return p.buf.pos
 }
 
 func NewParser(r io.Reader) *Parser {
 	return &Parser{s: NewScanner(r)}
 }
 
-func createField(fieldType Token, name string) *Field {
+func createField(fieldType Token, name string) (*Field, error) {
 	n := &Field{Type: fieldType, Name: name}
 	switch n.Type {
 	case TYPE_STRING, TYPE_PROPERTY:
 		n.StringVal = name
 	case TYPE_INT:
 		if v, err := strconv.Atoi(name); err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid integer %q", name)
 		} else {
 			n.IntVal = v
 		}
 	case TYPE_FLOAT:
 		if v, err := strconv.ParseFloat(name, 64); err != nil {
-			panic(err)
+			return nil, fmt.Errorf("invalid number %q", name)
 		} else {
 			n.FloatVal = v
 		}
+	case TYPE_DURATION:
+		if v, err := parseDuration(name); err != nil {
+			return nil, err
+		} else {
+			n.IntVal = v
+		}
+	case TYPE_BOOL:
+		if v, err := strconv.ParseBool(strings.ToLower(name)); err != nil {
+			return nil, fmt.Errorf("invalid boolean %q", name)
+		} else {
+			n.BoolVal = v
+		}
 	}
-	return n
+	return n, nil
 }
-
 func tokenToField(tok Token, lit string) (*Field, error) {
 	switch tok {
 	case NUMBER:
-		return createField(TYPE_FLOAT, lit), nil
+		// Integers too large for an int are kept as floats.
+		if _, err := strconv.Atoi(lit); err == nil && !strings.ContainsAny(lit, ".eE") {
+			return createField(TYPE_INT, lit)
+		}
+		return createField(TYPE_FLOAT, lit)
+	case BOOLEAN:
+		return createField(TYPE_BOOL, lit)
+	case NULL:
+		return createField(TYPE_NIL, lit)
+	case DURATION:
+		return createField(TYPE_DURATION, lit)
 	case STRING:
-		return createField(TYPE_STRING, lit), nil
+		return createField(TYPE_STRING, lit)
 	case IDENT:
-		return createField(TYPE_PROPERTY, lit), nil
+		return createField(TYPE_PROPERTY, lit)
 	default:
 		return &Field{}, errors.New(fmt.Sprintf("Unable to determine type of Field to created for '%s'", lit))
 	}
 }
 
-func (p *Parser) parseField(stmt IStatement) (IField, error) {
-	tok, field := p.scanIgnoreWhitespace()
-	if tok == SUM || tok == COUNT {
-		var m AggregateMethod
-		if tok == SUM {
-			m = AGG_SUM
-		} else if tok == COUNT {
-			m = AGG_COUNT
+// operatorSymbols maps operator tokens to the text they are written as.
+var operatorSymbols = map[Token]string{
+	ADD:      "+",
+	SUBTRACT: "-",
+	MULTIPLY: "*",
+	DIVIDE:   "/",
+	EQ:       "=",
+	NOT_EQ:   "!=",
+	GT:       ">",
+	LT:       "<",
+	GTE:      ">=",
+	LTE:      "<=",
+}
+
+// exprString renders a field expression back into query syntax. It is used
+// to name fields that have no alias.
+func exprString(field IField) string {
+	if f, ok := field.(*Field); ok {
+		switch f.Type {
+		case TYPE_PROPERTY:
+			return f.StringVal
+		case TYPE_STRING:
+			return strconv.Quote(f.StringVal)
+		case TYPE_INT:
+			return strconv.Itoa(f.IntVal)
+		case TYPE_FLOAT:
+			return strconv.FormatFloat(f.FloatVal, 'f', -1, 64)
+		case TYPE_DURATION:
+			return formatDuration(f.IntVal)
+		case TYPE_BOOL:
+			return strconv.FormatBool(f.BoolVal)
+		case TYPE_NIL:
+			return "null"
+		}
+	} else if itr, ok := field.(*FieldItr); ok {
+		return itr.StringVal + " IN " + operandString(itr.Collection, 3)
+	} else if list, ok := field.(*ListLiteral); ok {
+		items := make([]string, len(list.Items))
+		for i, item := range list.Items {
+			items[i] = exprString(item)
+		}
+		return "(" + strings.Join(items, ", ") + ")"
+	} else if exp, ok := field.(*BinaryExpr); ok {
+		prec := precedence[exp.Operator]
+		// The right operand needs parens at equal precedence as operators
+		// are left associative.
+		return operandString(exp.Left, prec) + " " + operatorSymbols[exp.Operator] + " " + operandString(exp.Right, prec+1)
+	} else if neg, ok := field.(*UnaryExpr); ok {
+		return "-" + operandString(neg.Operand, 3)
+	} else if agg, ok := field.(*Aggregator); ok {
+		return string(agg.Method) + " " + operandString(agg.Target, 3)
+	} else if call, ok := field.(*FuncCall); ok {
+		args := make([]string, len(call.Args))
+		for i, arg := range call.Args {
+			args[i] = exprString(arg)
+		}
+		return call.Func + "(" + strings.Join(args, ", ") + ")"
+	}
+	return field.GetName()
+}
+
+// conditionString renders a condition back into query syntax.
+func conditionString(c ICondition) string {
+	if cmp, ok := c.(*Condition); ok {
+		return exprString(cmp.left) + " " + operatorSymbols[cmp.op] + " " + exprString(cmp.right)
+	} else if l, ok := c.(*LogicalCondition); ok {
+		op := "AND"
+		if l.Operator == OR {
+			op = "OR"
+		}
+		return conditionOperand(l.Left, l.Operator) + " " + op + " " + conditionOperand(l.Right, l.Operator)
+	} else if not, ok := c.(*NotCondition); ok {
+		return "NOT " + conditionOperand(not.Operand, NOT)
+	} else if isNull, ok := c.(*IsNullCondition); ok {
+		if isNull.Not {
+			return exprString(isNull.Operand) + " IS NOT NULL"
+		}
+		return exprString(isNull.Operand) + " IS NULL"
+	} else if exists, ok := c.(*ExistsCondition); ok {
+		return "EXISTS(" + exists.Property + ")"
+	} else if in, ok := c.(*InCondition); ok {
+		op := " IN "
+		if in.Not {
+			op = " NOT IN "
+		}
+		return exprString(in.Value) + op + exprString(in.Set)
+	} else if m, ok := c.(*MatchCondition); ok {
+		op := map[Token]string{LIKE: "LIKE", ILIKE: "ILIKE", MATCHES: "MATCHES"}[m.Operator]
+		if m.Not {
+			op = "NOT " + op
+		}
+		return exprString(m.Value) + " " + op + " " + strconv.Quote(m.Pattern)
+	} else if e, ok := c.(*exprCondition); ok {
+		return exprString(e.expr)
+	}
+	return ""
+}
+
+// conditionOperand renders a condition joined by op, parenthesising
+// conditions joined by other operators.
+func conditionOperand(c ICondition, op Token) string {
+	if l, ok := c.(*LogicalCondition); ok && l.Operator != op {
+		return "(" + conditionString(c) + ")"
+	}
+	return conditionString(c)
+}
+
+// operandString renders an operand, parenthesising binary expressions that
+// bind looser than minPrec.
+func operandString(field IField, minPrec int) string {
+	if exp, ok := field.(*BinaryExpr); ok && precedence[exp.Operator] < minPrec {
+		return "(" + exprString(exp) + ")"
+	}
+	return exprString(field)
+}
+
+// comparisonOperators lists the comparison operators for error messages.
+var comparisonOperators = []string{"=", "!=", "<", "<=", ">", ">=", "IS", "IN", "NOT IN", "LIKE", "ILIKE", "MATCHES"}
+
+// isComparisonOperator returns true for the operators of a Condition.
+func isComparisonOperator(tok Token) bool {
+	return tok == GT || tok == GTE || tok == EQ || tok == NOT_EQ || tok == LT || tok == LTE
+}
+
+// precedence holds the binding power of the arithmetic operators.
+var precedence = map[Token]int{
+	ADD:      1,
+	SUBTRACT: 1,
+	MULTIPLY: 2,
+	DIVIDE:   2,
+}
+
+// parseNamedExpr parses an expression with an optional "AS alias".
+// Expressions without an alias are named after their expression text.
+func (p *Parser) parseNamedExpr(others []IField) (IField, error) {
+	pos := p.nextPos()
+	f, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	name := exprString(f)
+	if tok, _ := p.scanIgnoreWhitespace(); tok == AS {
+		tok, lit := p.scanIgnoreWhitespace()
+		if tok != IDENT && !softKeywords[tok] {
+			return nil, p.expected("alias")
 		}
-		if targetField, err := p.parseField(stmt); err == nil {
-			return &Aggregator{Field: Field{Name: targetField.GetName()}, Method: m, Target: targetField}, nil
+		name = lit
+	} else {
+		p.unscan()
+	}
+
+	for _, other := range others {
+		if other.GetName() == name {
+			return nil, p.errorAt(pos, fmt.Sprintf("duplicate field name %q, use AS to rename it", name))
+		}
+	}
+	f.SetName(name)
+	if p.fieldPos == nil {
+		p.fieldPos = make(map[IField]Pos)
+	}
+	p.fieldPos[f] = pos
+	return f, nil
+}
+
+// parseKeys parses the comma-delimited keys a REDUCE groups on. Keys may be
+// MAP field names or expressions over them.
+func (p *Parser) parseKeys(rs *ReduceStatement) error {
+	for {
+		k, err := p.parseNamedExpr(rs.Keys)
+		if err != nil {
+			return err
+		}
+		rs.Keys = append(rs.Keys, k)
+		if tok, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+			p.unscan()
+			return nil
+		}
+	}
+}
+
+// parseExpr parses an arithmetic expression.
+func (p *Parser) parseExpr() (IField, error) {
+	return p.parseBinary(nil, 0)
+}
+
+// parseBinary parses binary operators of at least minPrec precedence using
+// precedence climbing. If left is non-nil it is used as the first operand,
+// which lets callers continue an expression they have already started.
+func (p *Parser) parseBinary(left IField, minPrec int) (IField, error) {
+	if left == nil {
+		var err error
+		if left, err = p.parseUnary(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		tok, _ := p.scanIgnoreWhitespace()
+		prec, ok := precedence[tok]
+		if !ok || prec < minPrec {
+			p.unscan()
+			return left, nil
+		}
+		right, err := p.parseBinary(nil, prec+1)
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Left: left, Operator: tok, Right: right}
+	}
+}
+
+// parseUnary parses an operand with an optional sign. Signed number
+// literals are folded into the literal.
+func (p *Parser) parseUnary() (IField, error) {
+	tok, _ := p.scanIgnoreWhitespace()
+	if tok != SUBTRACT && tok != ADD {
+		p.unscan()
+		return p.parsePrimary()
+	}
+	operand, err := p.parseUnary()
+	if err != nil || tok == ADD {
+		return operand, err
+	}
+	if f, ok := operand.(*Field); ok && f.Type == TYPE_FLOAT {
+		f.FloatVal = -f.FloatVal
+		f.Name = "-" + f.Name
+		return f, nil
+	} else if ok && f.Type == TYPE_INT {
+		f.IntVal = -f.IntVal
+		f.Name = "-" + f.Name
+		return f, nil
+	}
+	return &UnaryExpr{Operand: operand}, nil
+}
+
+// parsePrimary parses an aggregate, a parenthesised expression, a literal or
+// a property optionally plucked from a collection with IN.
+func (p *Parser) parsePrimary() (IField, error) {
+	tok, lit := p.scanIgnoreWhitespace()
+	if m, ok := aggregateMethods[tok]; ok && p.operandFollows() {
+		if targetField, err := p.parseUnary(); err == nil {
+			return &Aggregator{Method: m, Target: targetField}, nil
 		} else {
 			return nil, err
 		}
-	} else if tok == IDENT {
-		fieldNode := createField(TYPE_PROPERTY, field)
-		tok, _ = p.scanIgnoreWhitespace()
-		if tok == IN {
-			if collectionField, err := p.parseField(stmt); err == nil {
+	} else if tok == LPAREN {
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ = p.scanIgnoreWhitespace(); tok != RPAREN {
+			return nil, p.expected(")")
+		}
+		return expr, nil
+	} else if tok == NUMBER || tok == STRING || tok == DURATION || tok == BOOLEAN || tok == NULL {
+		f, err := tokenToField(tok, lit)
+		if err != nil {
+			return nil, p.errorAt(p.buf.pos, err.Error())
+		}
+		return f, nil
+	} else if tok == IDENT || softKeywords[tok] {
+		pos := p.buf.pos
+		fieldNode := &Field{Type: TYPE_PROPERTY, Name: lit, StringVal: lit}
+		if tok, _ = p.scanIgnoreWhitespace(); tok == LPAREN {
+			return p.parseCall(lit, pos)
+		} else if tok == IN {
+			// "name IN (...)" tests membership in a list rather than
+			// plucking from a collection.
+			if tok, _ = p.scanIgnoreWhitespace(); tok == LPAREN {
+				list, err := p.parseList()
+				if err != nil {
+					return nil, err
+				}
+				return &FieldItr{Field: *fieldNode, Collection: list, Operator: OP_IN}, nil
+			}
+			p.unscan()
+			if collectionField, err := p.parsePrimary(); err == nil {
 				return &FieldItr{Field: *fieldNode, Collection: collectionField, Operator: OP_IN}, nil
 			} else {
 				return nil, err
 			}
-		} else if tok == MULTIPLY {
-			if operandField, err := p.parseField(stmt); err == nil {
-				return &BinaryExpr{Left: fieldNode, Right: operandField, Operator: tok}, nil
-			} else {
+		}
+		p.unscan()
+		return fieldNode, nil
+	}
+	return nil, p.expected("property", "number", "string", "function", "aggregate method")
+}
+
+// operandFollows reports whether the next token can start an operand,
+// without consuming it.
+func (p *Parser) operandFollows() bool {
+	tok := p.peek()
+	if tok == IDENT || tok == NUMBER || tok == STRING || tok == LPAREN {
+		return true
+	}
+	return softKeywords[tok] && !clauseKeywords[tok]
+}
+
+// parseCall parses the comma-delimited arguments of a call to the function
+// name, after its opening paren. Errors about the call are reported at pos,
+// where name starts.
+func (p *Parser) parseCall(name string, pos Pos) (IField, error) {
+	call := &FuncCall{Func: strings.ToLower(name), Args: make([]IField, 0)}
+	fn, ok := functions[call.Func]
+	if !ok {
+		return nil, p.errorAt(pos, fmt.Sprintf("unknown function %q", name))
+	}
+
+	if tok, _ := p.scanIgnoreWhitespace(); tok != RPAREN {
+		p.unscan()
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
 				return nil, err
 			}
-		} else if tok == COMMA {
-			return fieldNode, nil
-		} else {
-			p.unscan()
-			return fieldNode, nil
+			call.Args = append(call.Args, arg)
+
+			if tok, _ := p.scanIgnoreWhitespace(); tok == RPAREN {
+				break
+			} else if tok != COMMA {
+				return nil, p.expected(",", ")")
+			}
 		}
-	} else {
-		return nil, fmt.Errorf("Found %d, expected IDENT or SUM", field)
 	}
+
+	if len(call.Args) < fn.minArgs || len(call.Args) > fn.maxArgs {
+		if fn.maxArgs == math.MaxInt32 {
+			return nil, p.errorAt(pos, fmt.Sprintf("%s takes at least %d argument(s), got %d", call.Func, fn.minArgs, len(call.Args)))
+		} else if fn.minArgs == fn.maxArgs {
+			return nil, p.errorAt(pos, fmt.Sprintf("%s takes %d argument(s), got %d", call.Func, fn.minArgs, len(call.Args)))
+		}
+		return nil, p.errorAt(pos, fmt.Sprintf("%s takes %d to %d arguments, got %d", call.Func, fn.minArgs, fn.maxArgs, len(call.Args)))
+	}
+	if fn.check != nil {
+		if err := fn.check(call.Args); err != nil {
+			return nil, p.errorAt(pos, err.Error())
+		}
+	}
+	return call, nil
 }
 
+// parseFields parses the fields of a statement, up to the keyword of the
+// next clause. Soft clause keywords such as ORDER only end the fields in
+// place of a comma, so fields may still be named after them.
 func (p *Parser) parseFields(stmt IStatement) error {
+	comma := true
 	for true {
 		var tok Token
 		tok, _ = p.scanIgnoreWhitespace()
-		if tok == EOF || tok == REDUCE || tok == ON || tok == WHERE {
-			p.unscan()
+		p.unscan()
+		if tok == EOF || tok == REDUCE || tok == ON || tok == WHERE || (!comma && clauseKeywords[tok]) {
 			break
-		} else {
+		} else if _, ok := stmt.(*ReduceStatement); ok && tok == HAVING {
+			// A REDUCE without fields may go straight to HAVING.
+			break
+		}
+		f, err := p.parseNamedExpr(stmt.GetFields())
+		if err != nil {
+			return err
+		}
+		stmt.AddField(f)
+		if tok, _ = p.scanIgnoreWhitespace(); tok != COMMA {
 			p.unscan()
-			if f, err := p.parseField(stmt); err == nil {
-				stmt.AddField(f)
-			} else {
-				panic(err)
-			}
 		}
+		comma = tok == COMMA
 	}
 	return nil
 }
 
 func (p *Parser) parseWhere(stmt IStatement) error {
+	c, err := p.parseOr()
+	if err == nil {
+		err = checkCondition(c)
+	}
+	if err != nil {
+		return err
+	}
+	stmt.SetCondition(c)
+	return nil
+}
+
+// checkCondition returns an error if c is an expression with no comparison.
+func checkCondition(c ICondition) error {
+	if e, ok := c.(*exprCondition); ok {
+		return &ParseError{
+			Pos:      e.end,
+			Found:    `")"`,
+			Expected: comparisonOperators,
+			Msg:      fmt.Sprintf("expected operator after %q", exprString(e.expr)),
+		}
+	}
+	return nil
+}
+
+// parseOr parses conditions joined by OR, the lowest precedence operator.
+func (p *Parser) parseOr() (ICondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
 	for {
-		condition := Condition{}
+		if tok, _ := p.scanIgnoreWhitespace(); tok != OR {
+			p.unscan()
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCondition(left); err != nil {
+			return nil, err
+		}
+		if err := checkCondition(right); err != nil {
+			return nil, err
+		}
+		left = &LogicalCondition{Left: left, Operator: OR, Right: right}
+	}
+}
 
-		// Read a left side of condition
-		tok, lit := p.scanIgnoreWhitespace()
-		l, err := tokenToField(tok, lit)
+// parseAnd parses conditions joined by AND.
+func (p *Parser) parseAnd() (ICondition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if tok, _ := p.scanIgnoreWhitespace(); tok != AND {
+			p.unscan()
+			return left, nil
+		}
+		right, err := p.parseNot()
 		if err != nil {
-			return err
-		} else {
-			condition.left = l
+			return nil, err
 		}
+		if err := checkCondition(left); err != nil {
+			return nil, err
+		}
+		if err := checkCondition(right); err != nil {
+			return nil, err
+		}
+		left = &LogicalCondition{Left: left, Operator: AND, Right: right}
+	}
+}
 
-		// Read operator
-		tok, lit = p.scanIgnoreWhitespace()
-		if !(tok == GT || tok == GTE || tok == EQ || tok == NOT_EQ || tok == LT || tok == LTE) {
-			return fmt.Errorf("found %q, expected operator", lit)
+// parseNot parses a negated condition, a parenthesised condition, an
+// EXISTS test or a single comparison.
+func (p *Parser) parseNot() (ICondition, error) {
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok == EXISTS {
+		if p.peek() == LPAREN {
+			return p.parseExists()
+		}
+		// Without a paren EXISTS names a property, as in "exists = 1".
+		return p.parseComparison(&Field{Type: TYPE_PROPERTY, Name: lit, StringVal: lit})
+	} else if tok == NOT {
+		operand, err := p.parseNot()
+		if err == nil {
+			err = checkCondition(operand)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &NotCondition{Operand: operand}, nil
+	} else if tok == LPAREN {
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ = p.scanIgnoreWhitespace(); tok != RPAREN {
+			return nil, p.expected(")")
+		}
+		// The parens wrapped an arithmetic expression, so carry on parsing
+		// the rest of the expression and its comparison.
+		if e, ok := c.(*exprCondition); ok {
+			return p.parseComparison(e.expr)
 		}
-		condition.op = tok
+		return c, nil
+	}
+	p.unscan()
+	return p.parseComparison(nil)
+}
 
-		// Read operand
-		tok, lit = p.scanIgnoreWhitespace()
-		r, err := tokenToField(tok, lit)
+// parseList parses the comma-delimited literals of a list, after its opening
+// paren, and hashes them.
+func (p *Parser) parseList() (*ListLiteral, error) {
+	list := &ListLiteral{Items: make([]IField, 0), set: make(map[string]bool)}
+	for {
+		pos := p.nextPos()
+		item, err := p.parseExpr()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		f, ok := item.(*Field)
+		if !ok || f.Type == TYPE_PROPERTY {
+			return nil, p.errorAt(pos, fmt.Sprintf("found %q, expected a literal in list", exprString(item)))
+		}
+		list.Items = append(list.Items, f)
+		if key, ok := setKey(literalValue(f)); ok {
+			list.set[key] = true
 		} else {
-			condition.right = r
+			list.hasNull = true
 		}
 
-		stmt.AddCondition(condition)
-
-		if tok, _ := p.scanIgnoreWhitespace(); tok != AND {
-			p.unscan()
+		if tok, _ := p.scanIgnoreWhitespace(); tok == RPAREN {
 			break
+		} else if tok != COMMA {
+			return nil, p.expected(",", ")")
 		}
 	}
-	return nil
+	list.Name = exprString(list)
+	return list, nil
+}
+
+// parseIn parses the list or list valued expression after IN.
+func (p *Parser) parseIn(value IField, not bool) (ICondition, error) {
+	var set IField
+	var err error
+	if tok, _ := p.scanIgnoreWhitespace(); tok == LPAREN {
+		set, err = p.parseList()
+	} else {
+		p.unscan()
+		set, err = p.parseUnary()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &InCondition{Value: value, Set: set, Not: not}, nil
+}
+
+// parseMatch parses the string literal pattern after LIKE, ILIKE or MATCHES
+// and compiles it.
+func (p *Parser) parseMatch(value IField, op Token, not bool) (ICondition, error) {
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok != STRING {
+		return nil, p.expected("a string pattern")
+	}
+	re, err := compilePattern(op, lit)
+	if err != nil {
+		return nil, p.errorAt(p.buf.pos, fmt.Sprintf("invalid pattern %q: %v", lit, err))
+	}
+	return &MatchCondition{Value: value, Operator: op, Pattern: lit, Not: not, re: re}, nil
+}
+
+// parseExists parses "(property)" after EXISTS.
+func (p *Parser) parseExists() (ICondition, error) {
+	if tok, _ := p.scanIgnoreWhitespace(); tok != LPAREN {
+		return nil, p.expected("(")
+	}
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok != IDENT && !softKeywords[tok] {
+		return nil, p.expected("property")
+	}
+	if tok, _ := p.scanIgnoreWhitespace(); tok != RPAREN {
+		return nil, p.expected(")")
+	}
+	return &ExistsCondition{Property: lit}, nil
+}
+
+// parseComparison parses "expr op expr" or "expr IS [NOT] NULL". If left is
+// non-nil it is the start of the left hand expression, already consumed by
+// the caller.
+func (p *Parser) parseComparison(left IField) (ICondition, error) {
+	condition := &Condition{}
+
+	// Read a left side of condition
+	l, err := p.parseBinary(left, 0)
+	if err != nil {
+		return nil, err
+	}
+	condition.left = l
+
+	// Read operator
+	tok, _ := p.scanIgnoreWhitespace()
+	if itr, ok := l.(*FieldItr); ok && !isComparisonOperator(tok) {
+		// Without a comparison, "name IN collection" is a membership test.
+		p.unscan()
+		value := &Field{Type: TYPE_PROPERTY, Name: itr.StringVal, StringVal: itr.StringVal}
+		return &InCondition{Value: value, Set: itr.Collection}, nil
+	} else if tok == IN {
+		return p.parseIn(l, false)
+	} else if tok == LIKE || tok == ILIKE || tok == MATCHES {
+		return p.parseMatch(l, tok, false)
+	} else if tok == NOT {
+		tok, _ = p.scanIgnoreWhitespace()
+		if tok == LIKE || tok == ILIKE || tok == MATCHES {
+			return p.parseMatch(l, tok, true)
+		} else if tok != IN {
+			return nil, p.expected("IN", "LIKE", "ILIKE", "MATCHES")
+		}
+		return p.parseIn(l, true)
+	} else if tok == RPAREN {
+		p.unscan()
+		return &exprCondition{expr: l, end: p.buf.pos}, nil
+	} else if tok == IS {
+		c := &IsNullCondition{Operand: l}
+		if tok, _ = p.scanIgnoreWhitespace(); tok == NOT {
+			c.Not = true
+			tok, _ = p.scanIgnoreWhitespace()
+		}
+		if tok != NULL {
+			return nil, p.expected("NULL")
+		}
+		return c, nil
+	} else if !isComparisonOperator(tok) {
+		return nil, p.expected(comparisonOperators...)
+	}
+	condition.op = tok
+
+	// Read operand
+	r, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	condition.right = r
+
+	return condition, nil
 }
 
 // Parse parses a MAP REDUCE statement.
@@ -269,9 +1064,17 @@ func (p *Parser) Parse() (*Statement, *ReduceStatement, error) {
 	ms := &Statement{}
 	rs := &ReduceStatement{}
 
+	// The query may start with EXPLAIN or ANALYZE. They are only special
+	// here, so properties may still have those names.
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok == IDENT && (strings.EqualFold(lit, "EXPLAIN") || strings.EqualFold(lit, "ANALYZE")) {
+		p.prefix = strings.ToUpper(lit)
+		tok, _ = p.scanIgnoreWhitespace()
+	}
+
 	// First token should be a "MAP" keyword.
-	if tok, lit := p.scanIgnoreWhitespace(); tok != MAP {
-		return nil, nil, fmt.Errorf("found %q, expected MAP", lit)
+	if tok != MAP {
+		return nil, nil, p.expected("MAP")
 	}
 
 	// Next we should loop over all our comma-delimited fields for the MAP statement
@@ -281,45 +1084,399 @@ func (p *Parser) Parse() (*Statement, *ReduceStatement, error) {
 
 	// Check for conditionals in MAP
 	if tok, _ := p.scan(); tok == WHERE {
-		p.parseWhere(ms)
+		if err := p.parseWhere(ms); err != nil {
+			return nil, nil, err
+		}
 	} else {
 		p.unscan()
 	}
 
-	// Next we should see the "REDUCE" keyword.
-	tok, lit := p.scanIgnoreWhitespace()
-	if tok != EOF {
-		if tok != REDUCE {
-			return nil, nil, fmt.Errorf("found %s, expected REDUCE", lit)
-		}
-
+	// Next we may see the "REDUCE" keyword.
+	out := ms
+	tok, _ = p.scanIgnoreWhitespace()
+	if tok == REDUCE {
 		if err := p.parseFields(rs); err != nil {
 			return nil, nil, err
 		}
 
-		// Check for conditionals in REDUCE
-		if tok, _ := p.scan(); tok == WHERE {
-			p.parseWhere(rs)
+		// Check for a HAVING condition, which may also be written as WHERE
+		// before ON.
+		if tok, _ := p.scan(); tok == WHERE || tok == HAVING {
+			if err := p.parseHaving(rs); err != nil {
+				return nil, nil, err
+			}
 		} else {
 			p.unscan()
 		}
 
-		if tok, lit := p.scanIgnoreWhitespace(); tok != ON {
-			return nil, nil, fmt.Errorf("found %s, expected ON", lit)
+		if tok, _ := p.scanIgnoreWhitespace(); tok != ON {
+			return nil, nil, p.expected("ON")
 		}
 
-		// Finally we should read the reduce key.
-		tok, lit := p.scanIgnoreWhitespace()
-		if tok != IDENT {
-			return nil, nil, fmt.Errorf("found %s, expected reduce key", lit)
+		// Then we should read the comma-delimited reduce keys.
+		if err := p.parseKeys(rs); err != nil {
+			return nil, nil, err
+		}
+		if err := p.checkOutputNames(rs); err != nil {
+			return nil, nil, err
 		}
-		rs.Key = lit
+
+		out = &rs.Statement
+		tok, _ = p.scanIgnoreWhitespace()
+		if tok == HAVING {
+			if rs.Having != nil {
+				return nil, nil, p.errorAt(p.buf.pos, "REDUCE already has a HAVING condition")
+			}
+			if err := p.parseHaving(rs); err != nil {
+				return nil, nil, err
+			}
+			tok, _ = p.scanIgnoreWhitespace()
+		}
+		if err := p.resolveReduce(ms, rs); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// ORDER BY and LIMIT apply to the output of the last statement.
+	if tok == ORDER || tok == LIMIT {
+		p.unscan()
+		columns := ms.Fields
+		if out != ms {
+			columns = append(append([]IField{}, rs.Keys...), rs.Fields...)
+			columns = append(columns, &Field{Type: TYPE_PROPERTY, Name: "_count", StringVal: "_count"})
+		}
+		if err := p.parseOrderLimit(out, columns); err != nil {
+			return nil, nil, err
+		}
+		tok, _ = p.scanIgnoreWhitespace()
+	}
+
+	if tok != EOF {
+		if out == ms {
+			return nil, nil, p.expected("REDUCE", "end of query")
+		}
+		return nil, nil, p.expected("end of query")
 	}
 
 	// Return the successfully parsed statement.
 	return ms, rs, nil
 }
 
+// checkOutputNames returns an error if a REDUCE field is named after a key
+// or _count without being it, or a key is named _count, as each group's
+// output row holds the fields, the keys and _count under their names.
+func (p *Parser) checkOutputNames(rs *ReduceStatement) error {
+	keys := make(map[string]bool)
+	for _, k := range rs.Keys {
+		if k.GetName() == "_count" {
+			return p.errorAt(p.fieldPos[k], `key name "_count" is taken by the row count, use AS to rename it`)
+		}
+		keys[k.GetName()] = true
+	}
+	for _, f := range rs.Fields {
+		name := f.GetName()
+		if name == "_count" && !isProperty(f, name) {
+			return p.errorAt(p.fieldPos[f], `field name "_count" is taken by the row count, use AS to rename it`)
+		} else if keys[name] && !isProperty(f, name) {
+			return p.errorAt(p.fieldPos[f], fmt.Sprintf("field name %q is taken by a REDUCE key, use AS to rename it", name))
+		}
+	}
+	return nil
+}
+
+// checkColumns returns an error if f reads a property that isn't one of
+// columns. A path may read into a column, as in "user.plan" for a MAP field
+// "user".
+func checkColumns(f IField, columns map[string]bool, what string) error {
+	if leaf, ok := f.(*Field); ok && leaf.Type == TYPE_PROPERTY {
+		if columns[leaf.StringVal] {
+			return nil
+		}
+		if segments := splitPath(leaf.StringVal); len(segments) > 0 {
+			if root, ok := segments[0].(string); ok && columns[root] {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q in %s must be a MAP field", leaf.StringVal, what)
+	} else if itr, ok := f.(*FieldItr); ok {
+		return checkColumns(itr.Collection, columns, what)
+	} else if exp, ok := f.(*BinaryExpr); ok {
+		if err := checkColumns(exp.Left, columns, what); err != nil {
+			return err
+		}
+		return checkColumns(exp.Right, columns, what)
+	} else if neg, ok := f.(*UnaryExpr); ok {
+		return checkColumns(neg.Operand, columns, what)
+	} else if agg, ok := f.(*Aggregator); ok {
+		return checkColumns(agg.Target, columns, what)
+	} else if call, ok := f.(*FuncCall); ok {
+		for _, arg := range call.Args {
+			if err := checkColumns(arg, columns, what); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseHaving parses the condition after HAVING, or WHERE in a REDUCE. It
+// is resolved by resolveReduce once the REDUCE keys have been parsed, as a
+// condition before ON comes before them.
+func (p *Parser) parseHaving(rs *ReduceStatement) error {
+	pos := p.buf.pos
+	c, err := p.parseOr()
+	if err == nil {
+		err = checkCondition(c)
+	}
+	if err != nil {
+		return err
+	}
+	rs.Having = c
+	p.havingPos = pos
+	return nil
+}
+
+// resolveReduce rewrites a REDUCE's fields and HAVING condition to read the
+// computed columns of a group rather than the mapped rows. Every aggregate
+// is collected into rs.aggs, to be updated row by row as the query runs, and
+// replaced by a reference to its result. Other properties must name a
+// REDUCE key, _count or, in HAVING and later fields, a REDUCE field. Keys
+// and aggregate targets must read MAP fields, as REDUCE only sees the MAP
+// output.
+func (p *Parser) resolveReduce(ms *Statement, rs *ReduceStatement) error {
+	r := &reduceResolver{
+		p:          p,
+		rs:         rs,
+		columns:    map[string]bool{"_count": true},
+		mapColumns: make(map[string]bool),
+	}
+	for _, f := range ms.Fields {
+		r.mapColumns[f.GetName()] = true
+	}
+	for _, k := range rs.Keys {
+		if err := checkColumns(k, r.mapColumns, "REDUCE key"); err != nil {
+			return p.errorAt(p.fieldPos[k], err.Error())
+		}
+		r.columns[k.GetName()] = true
+	}
+
+	r.clause = "REDUCE"
+	rs.outputs = make([]IField, len(rs.Fields))
+	for i, f := range rs.Fields {
+		r.pos = p.fieldPos[f]
+		out, err := r.field(f)
+		if err != nil {
+			return err
+		}
+		rs.outputs[i] = out
+		r.columns[f.GetName()] = true
+	}
+
+	if rs.Having != nil {
+		r.clause, r.pos = "HAVING", p.havingPos
+		having, err := r.condition(rs.Having)
+		if err != nil {
+			return err
+		}
+		rs.Having = having
+	}
+	return nil
+}
+
+// reduceResolver rewrites the expressions of a REDUCE, see resolveReduce.
+type reduceResolver struct {
+	p       *Parser
+	rs      *ReduceStatement
+	columns map[string]bool
+	// mapColumns are the names of the MAP fields.
+	mapColumns map[string]bool
+	// clause and pos say where the expression being resolved is, for errors.
+	clause string
+	pos    Pos
+}
+
+func (r *reduceResolver) errorf(format string, args ...interface{}) error {
+	return r.p.errorAt(r.pos, fmt.Sprintf(format, args...))
+}
+
+func (r *reduceResolver) field(f IField) (IField, error) {
+	if leaf, ok := f.(*Field); ok {
+		if leaf.Type == TYPE_PROPERTY && !r.columns[leaf.StringVal] {
+			return nil, r.errorf("%q in %s must be aggregated, or be a REDUCE key or field", leaf.StringVal, r.clause)
+		}
+		return leaf, nil
+	} else if agg, ok := f.(*Aggregator); ok {
+		if err := checkColumns(agg.Target, r.mapColumns, string(agg.Method)); err != nil {
+			return nil, r.p.errorAt(r.pos, err.Error())
+		}
+		name := "\x00" + exprString(agg)
+		if !r.columns[name] {
+			r.columns[name] = true
+			r.rs.aggs = append(r.rs.aggs, &Aggregator{Field: Field{Name: name}, Target: agg.Target, Method: agg.Method})
+		}
+		return &Field{Type: TYPE_PROPERTY, Name: name, StringVal: name}, nil
+	} else if exp, ok := f.(*BinaryExpr); ok {
+		left, err := r.field(exp.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := r.field(exp.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &BinaryExpr{Field: exp.Field, Left: left, Operator: exp.Operator, Right: right}, nil
+	} else if neg, ok := f.(*UnaryExpr); ok {
+		operand, err := r.field(neg.Operand)
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Field: neg.Field, Operand: operand}, nil
+	} else if call, ok := f.(*FuncCall); ok {
+		resolved := &FuncCall{Field: call.Field, Func: call.Func, Args: make([]IField, len(call.Args))}
+		for i, arg := range call.Args {
+			var err error
+			if resolved.Args[i], err = r.field(arg); err != nil {
+				return nil, err
+			}
+		}
+		return resolved, nil
+	} else if list, ok := f.(*ListLiteral); ok {
+		return list, nil
+	}
+	return nil, r.errorf("%q in %s must be aggregated, or be a REDUCE key or field", exprString(f), r.clause)
+}
+
+func (r *reduceResolver) condition(c ICondition) (ICondition, error) {
+	var err error
+	if cmp, ok := c.(*Condition); ok {
+		resolved := &Condition{op: cmp.op}
+		if resolved.left, err = r.field(cmp.left); err != nil {
+			return nil, err
+		}
+		if resolved.right, err = r.field(cmp.right); err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	} else if l, ok := c.(*LogicalCondition); ok {
+		resolved := &LogicalCondition{Operator: l.Operator}
+		if resolved.Left, err = r.condition(l.Left); err != nil {
+			return nil, err
+		}
+		if resolved.Right, err = r.condition(l.Right); err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	} else if not, ok := c.(*NotCondition); ok {
+		resolved := &NotCondition{}
+		if resolved.Operand, err = r.condition(not.Operand); err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	} else if isNull, ok := c.(*IsNullCondition); ok {
+		resolved := &IsNullCondition{Not: isNull.Not}
+		if resolved.Operand, err = r.field(isNull.Operand); err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	} else if in, ok := c.(*InCondition); ok {
+		resolved := &InCondition{Not: in.Not}
+		if resolved.Value, err = r.field(in.Value); err != nil {
+			return nil, err
+		}
+		if resolved.Set, err = r.field(in.Set); err != nil {
+			return nil, err
+		}
+		return resolved, nil
+	} else if m, ok := c.(*MatchCondition); ok {
+		resolved := *m
+		if resolved.Value, err = r.field(m.Value); err != nil {
+			return nil, err
+		}
+		return &resolved, nil
+	} else if exists, ok := c.(*ExistsCondition); ok {
+		if !r.columns[exists.Property] {
+			return nil, r.errorf("%q in %s must be a REDUCE key or field", exists.Property, r.clause)
+		}
+		return exists, nil
+	}
+	return c, nil
+}
+
+// parseOrderLimit parses optional "ORDER BY expr [ASC|DESC], ..." and
+// "LIMIT n" clauses. Each ORDER BY term must name one of the output columns,
+// by its name or by its expression, and is resolved to read that column.
+func (p *Parser) parseOrderLimit(stmt *Statement, columns []IField) error {
+	if tok, _ := p.scanIgnoreWhitespace(); tok == ORDER {
+		if tok, _ := p.scanIgnoreWhitespace(); tok != BY {
+			return p.expected("BY")
+		}
+		for {
+			pos := p.nextPos()
+			f, err := p.parseExpr()
+			if err != nil {
+				return err
+			}
+			name, ok := outputColumn(f, columns)
+			if !ok {
+				return p.errorAt(pos, fmt.Sprintf("%q in ORDER BY must be an output column", exprString(f)))
+			}
+			o := OrderBy{Field: &Field{Type: TYPE_PROPERTY, Name: name, StringVal: name}}
+			if tok, _ := p.scanIgnoreWhitespace(); tok == DESC {
+				o.Desc = true
+			} else if tok != ASC {
+				p.unscan()
+			}
+			stmt.OrderBy = append(stmt.OrderBy, o)
+
+			if tok, _ := p.scanIgnoreWhitespace(); tok != COMMA {
+				p.unscan()
+				break
+			}
+		}
+	} else {
+		p.unscan()
+	}
+
+	if tok, _ := p.scanIgnoreWhitespace(); tok == LIMIT {
+		tok, lit := p.scanIgnoreWhitespace()
+		n, err := strconv.Atoi(lit)
+		if tok != NUMBER || err != nil || n <= 0 {
+			return p.expected("a positive integer")
+		}
+		stmt.Limit = n
+	} else {
+		p.unscan()
+	}
+	return nil
+}
+
+// outputColumn returns the name of the column among columns that f refers
+// to, either by the column's name or by repeating its expression. Names take
+// precedence, so an alias can be ordered by even when it is also the name of
+// a property.
+func outputColumn(f IField, columns []IField) (string, bool) {
+	if leaf, ok := f.(*Field); ok && leaf.Type == TYPE_PROPERTY {
+		for _, c := range columns {
+			if c.GetName() == leaf.StringVal {
+				return c.GetName(), true
+			}
+		}
+	}
+	expr := exprString(f)
+	for _, c := range columns {
+		if exprString(c) == expr {
+			return c.GetName(), true
+		}
+	}
+	return "", false
+}
+
+// isProperty reports whether f is a reference to the property name.
+func isProperty(f IField, name string) bool {
+	leaf, ok := f.(*Field)
+	return ok && leaf.Type == TYPE_PROPERTY && leaf.StringVal == name
+}
+
 // scan returns the next token from the underlying scanner.
 // If a token has been unscanned then read that instead.
 func (p *Parser) scan() (tok Token, lit string) {
@@ -333,7 +1490,7 @@ func (p *Parser) scan() (tok Token, lit string) {
 	tok, lit = p.s.Scan()
 
 	// Save it to the buffer in case we unscan later.
-	p.buf.tok, p.buf.lit = tok, lit
+	p.buf.tok, p.buf.lit, p.buf.pos, p.buf.err = tok, lit, p.s.Pos(), p.s.Err()
 
 	return
 }
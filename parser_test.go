@@ -0,0 +1,609 @@
+package gofigure
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv evaluates expressions in UTC.
+var testEnv = &env{loc: time.UTC}
+
+// parseWhere parses cond as the WHERE condition of a MAP.
+func parseWhere(t *testing.T, cond string) ICondition {
+	t.Helper()
+	ms, _, err := NewParser(strings.NewReader("MAP a WHERE " + cond)).Parse()
+	if err != nil {
+		t.Fatalf("%s: %v", cond, err)
+	}
+	return ms.Condition
+}
+
+func TestWhereLogic(t *testing.T) {
+	row := map[string]interface{}{"a": 1.0, "b": 2.0, "c": 3.0}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"a = 1", true},
+		{"a = 1 AND b = 1", false},
+		{"a = 2 OR b = 2", true},
+		{"a = 2 OR b = 1", false},
+		// AND binds tighter than OR, and NOT tighter than both.
+		{"a = 1 OR b = 1 AND c = 1", true},
+		{"(a = 1 OR b = 1) AND c = 1", false},
+		{"NOT a = 1 OR b = 2", true},
+		{"NOT (a = 1 OR b = 2)", false},
+		{"NOT NOT a = 1", true},
+		{"a = 1 AND (b = 1 OR (c = 3 AND NOT b = 1))", true},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestWhereErrors(t *testing.T) {
+	for _, cond := range []string{
+		"(a = 1",
+		"a = 1 AND",
+		"NOT",
+		"a = 1 OR )",
+	} {
+		if _, _, err := NewParser(strings.NewReader("MAP a WHERE " + cond)).Parse(); err == nil {
+			t.Errorf("%s: expected an error", cond)
+		}
+	}
+}
+
+// parseExprField parses expr as the only field of a MAP.
+func parseExprField(t *testing.T, expr string) IField {
+	t.Helper()
+	ms, _, err := NewParser(strings.NewReader("MAP " + expr)).Parse()
+	if err != nil {
+		t.Fatalf("%s: %v", expr, err)
+	}
+	if len(ms.Fields) != 1 {
+		t.Fatalf("%s: parsed %d fields, want 1", expr, len(ms.Fields))
+	}
+	return ms.Fields[0]
+}
+
+func TestArithmetic(t *testing.T) {
+	row := map[string]interface{}{"a": 3.0, "b": 4.0}
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"10 - 4 - 3", 3.0},
+		{"8 / 4 / 2", 1.0},
+		{"a * b - 2", 10.0},
+		{"a * (b - 2)", 6.0},
+		{"-a * 2", -6.0},
+		{"-(a + b)", -7.0},
+		{"a - -1", 4.0},
+		{"a / 0", nil},
+		{"a + missing", nil},
+	}
+	for _, test := range tests {
+		if got := evalField(testEnv, row, parseExprField(t, test.expr)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestWhereArithmetic(t *testing.T) {
+	row := map[string]interface{}{"price": 10.0, "discount": 2.0}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"(price - discount) > 5", true},
+		{"(price > 5)", true},
+		{"(price - discount) * 2 = 16", true},
+		{"price - discount * 2 = 6", true},
+		{"((price)) = 10 AND (discount < 1 OR price / 2 = 5)", true},
+		{"price > discount * 10", false},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+
+	for _, cond := range []string{"(price - discount)", "price - discount", "(price - discount) AND price > 1"} {
+		if _, _, err := NewParser(strings.NewReader("MAP price WHERE " + cond)).Parse(); err == nil {
+			t.Errorf("%s: expected an error", cond)
+		}
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{"price", []string{"price"}},
+		{"price * 2, price AS p", []string{"price * 2", "p"}},
+		{"(a + b) * c, a + b * c", []string{"(a + b) * c", "a + b * c"}},
+		{"a - (b - c), (a - b) - c", []string{"a - (b - c)", "a - b - c"}},
+		{"-price, -(a + b) AS neg", []string{"-price", "neg"}},
+		{"0 - price", []string{"0 - price"}},
+		{"SUM revenue, SUM revenue / COUNT orders AS avg_rev", []string{"SUM revenue", "avg_rev"}},
+	}
+	for _, test := range tests {
+		ms, _, err := NewParser(strings.NewReader("MAP " + test.fields)).Parse()
+		if err != nil {
+			t.Errorf("%s: %v", test.fields, err)
+			continue
+		}
+		var names []string
+		for _, f := range ms.Fields {
+			names = append(names, f.GetName())
+		}
+		if strings.Join(names, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got names %q, want %q", test.fields, names, test.want)
+		}
+	}
+}
+
+// parseError returns the error parsing query gives.
+func parseError(query string) error {
+	_, err := Parse(query)
+	return err
+}
+
+func TestFieldNameErrors(t *testing.T) {
+	for _, query := range []string{
+		"MAP a, a",
+		"MAP a, b AS a",
+		"MAP a + 1, a+1",
+		"MAP a AS",
+		"MAP a REDUCE SUM a AS _count ON a",
+		"MAP a REDUCE COUNT a, SUM a AS COUNT_a, SUM a AS COUNT_a ON a",
+	} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+	if err := parseError("MAP a REDUCE _count, SUM a ON a"); err != nil {
+		t.Errorf("_count as a REDUCE field: %v", err)
+	}
+}
+
+func TestOrderByErrors(t *testing.T) {
+	for _, query := range []string{
+		"MAP a ORDER a",
+		"MAP a ORDER BY",
+		"MAP a ORDER BY b",
+		"MAP a * 2 ORDER BY a",
+		"MAP a LIMIT 0",
+		"MAP a LIMIT -1",
+		"MAP a LIMIT x",
+		"MAP a, v REDUCE SUM v ON a ORDER BY v",
+		"MAP a ORDER BY a LIMIT 1 ORDER BY a",
+	} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestOrderByColumns(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+		desc  []bool
+		limit int
+	}{
+		{"MAP a, b ORDER BY b DESC, a", []string{"b", "a"}, []bool{true, false}, 0},
+		{"MAP a * 2 AS x ORDER BY a * 2 LIMIT 3", []string{"x"}, []bool{false}, 3},
+		{"MAP a AS b, b AS a ORDER BY a ASC", []string{"a"}, []bool{false}, 0},
+		{"MAP a, v REDUCE SUM v ON a ORDER BY SUM v DESC, _count, a", []string{"SUM v", "_count", "a"}, []bool{true, false, false}, 0},
+		{"MAP a LIMIT 10", nil, nil, 10},
+	}
+	for _, test := range tests {
+		ms, rs, err := NewParser(strings.NewReader(test.query)).Parse()
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		out := ms
+		if len(rs.Keys) > 0 {
+			out = &rs.Statement
+		}
+		var names []string
+		var desc []bool
+		for _, o := range out.OrderBy {
+			names = append(names, o.Field.GetName())
+			desc = append(desc, o.Desc)
+		}
+		if strings.Join(names, "|") != strings.Join(test.want, "|") || fmt.Sprint(desc) != fmt.Sprint(test.desc) || out.Limit != test.limit {
+			t.Errorf("%s: got %q %v LIMIT %d, want %q %v LIMIT %d", test.query, names, desc, out.Limit, test.want, test.desc, test.limit)
+		}
+	}
+}
+
+func TestContextualKeywords(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"MAP order", []string{"order"}},
+		{"MAP min, max, max - min AS range", []string{"min", "max", "range"}},
+		{"MAP a AS avg, b AS limit", []string{"avg", "limit"}},
+		{"MAP desc ORDER BY desc DESC", []string{"desc"}},
+		{"MAP count ORDER BY count LIMIT 1", []string{"count"}},
+		{"MAP `order`, `MAP` AS `by`", []string{"order", "by"}},
+		{"MAP `two words`", []string{"two words"}},
+	}
+	for _, test := range tests {
+		ms, _, err := NewParser(strings.NewReader(test.query)).Parse()
+		if err != nil {
+			t.Errorf("%s: %v", test.query, err)
+			continue
+		}
+		var names []string
+		for _, f := range ms.Fields {
+			names = append(names, f.GetName())
+		}
+		if strings.Join(names, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got names %q, want %q", test.query, names, test.want)
+		}
+	}
+
+	_, rs, err := NewParser(strings.NewReader("MAP `order`, sum REDUCE SUM `order`, MAX sum ON sum")).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, method := range []AggregateMethod{"SUM", "MAX"} {
+		if agg, ok := rs.Fields[i].(*Aggregator); !ok || agg.Method != method {
+			t.Errorf("REDUCE field %d: got %#v, want a %s aggregate", i, rs.Fields[i], method)
+		}
+	}
+
+	for _, query := range []string{"MAP `order", "MAP ``", "MAP a AS"} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestFunctionCalls(t *testing.T) {
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{"hour(_ts), DAY(_ts)", []string{"hour(_ts)", "day(_ts)"}},
+		{"bucket(_ts, 15m), bucket(_ts, 86400s)", []string{"bucket(_ts, 15m)", "bucket(_ts, 1d)"}},
+		{"week(_ts + 3600) AS w, hour", []string{"w", "hour"}},
+	}
+	for _, test := range tests {
+		ms, _, err := NewParser(strings.NewReader("MAP " + test.fields)).Parse()
+		if err != nil {
+			t.Errorf("%s: %v", test.fields, err)
+			continue
+		}
+		var names []string
+		for _, f := range ms.Fields {
+			names = append(names, f.GetName())
+		}
+		if strings.Join(names, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: got names %q, want %q", test.fields, names, test.want)
+		}
+	}
+
+	for _, query := range []string{
+		"MAP nope(_ts)",
+		"MAP hour()",
+		"MAP hour(_ts, _ts)",
+		"MAP bucket(_ts)",
+		"MAP bucket(_ts, 15)",
+		"MAP bucket(_ts, 0m)",
+		"MAP hour(_ts",
+		"MAP a REDUCE SUM a ON hour(_ts)",
+	} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		query        string
+		line, column int
+	}{
+		{"MAP a, )", 1, 8},
+		{"MAP a WHERE b >", 1, 16},
+		{"MAP a\nREDUCE SUM a\nON", 3, 3},
+		{"MAP a,\n  b AS", 2, 7},
+		{"MAP a, a", 1, 8},
+		{"MAP nope(a)", 1, 5},
+		{"MAP bucket(_ts, 5)", 1, 5},
+		{"MAP a\nORDER BY b", 2, 10},
+		{"MAP a LIMIT 0", 1, 13},
+		{"MAP a REDUCE SUM b ON a", 1, 14},
+		{"MAP a REDUCE SUM a ON\n  a, x", 2, 6},
+		{"MAP a, v REDUCE SUM v AS a ON a", 1, 17},
+		{"MAP a REDUCE COUNT a ON a AS _count", 1, 25},
+	}
+	for _, test := range tests {
+		err := parseError(test.query)
+		pe, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: got %v, want a *ParseError", test.query, err)
+			continue
+		}
+		if line, column := pe.Position(); line != test.line || column != test.column {
+			t.Errorf("%q: got %d:%d (%v), want %d:%d", test.query, line, column, err, test.line, test.column)
+		}
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	tests := []struct {
+		lit  string
+		want string
+	}{
+		{`"hello world"`, "hello world"},
+		{`'single quoted'`, "single quoted"},
+		{`"it's"`, "it's"},
+		{`'say "hi"'`, `say "hi"`},
+		{`"a\"b"`, `a"b`},
+		{`'a\'b'`, "a'b"},
+		{`"back\\slash"`, `back\slash`},
+		{`"tab\tnew\nline"`, "tab\tnew\nline"},
+		{`"été"`, "été"},
+		{`"caf\u00e9"`, "café"},
+		{`"été, AND OR"`, "été, AND OR"},
+		{`""`, ""},
+	}
+	for _, test := range tests {
+		if got := evalField(testEnv, nil, parseExprField(t, test.lit)); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.lit, got, test.want)
+		}
+	}
+
+	row := map[string]interface{}{"name": "Jane Doe"}
+	if !evalCondition(testEnv, row, parseWhere(t, `name = 'Jane Doe'`)) {
+		t.Errorf("name = 'Jane Doe': got false, want true")
+	}
+
+	errs := []struct {
+		query string
+		msg   string
+	}{
+		{`MAP a WHERE b = "open`, "unterminated string literal"},
+		{"MAP a WHERE b = 'open\n'", "unterminated string literal"},
+		{`MAP a WHERE b = "bad \q"`, `invalid escape \q in string literal`},
+		{`MAP a WHERE b = "bad \u12"`, `invalid escape \u12" in string literal`},
+		{"MAP `open", "unterminated quoted identifier"},
+		{"MAP ``", "empty quoted identifier"},
+	}
+	for _, test := range errs {
+		err := parseError(test.query)
+		if pe, ok := err.(*ParseError); !ok || pe.Msg != test.msg {
+			t.Errorf("%q: got %v, want %q", test.query, err, test.msg)
+		}
+	}
+}
+
+func TestLiterals(t *testing.T) {
+	row := map[string]interface{}{"v2": "property", "x": 2.0}
+	tests := []struct {
+		expr string
+		want interface{}
+		name string
+	}{
+		{"1", 1, "1"},
+		{"-1", -1, "-1"},
+		{"+1", 1, "1"},
+		{"1.0", 1.0, "1"},
+		{"1.5", 1.5, "1.5"},
+		{".5", 0.5, "0.5"},
+		{"1e3", 1000.0, "1000"},
+		{"1.5e-3", 0.0015, "0.0015"},
+		{"-2.5E+2", -250.0, "-250"},
+		{"99999999999999999999", 1e20, "100000000000000000000"},
+		{"true", true, "true"},
+		{"FALSE", false, "false"},
+		{"null", nil, "null"},
+		{"v2", "property", "v2"},
+		{"x-1", 1.0, "x - 1"},
+		{"x+1e2", 102.0, "x + 100"},
+	}
+	for _, test := range tests {
+		f := parseExprField(t, test.expr)
+		if got := evalField(testEnv, row, f); got != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.expr, got, test.want)
+		}
+		if f.GetName() != test.name {
+			t.Errorf("%s: got name %q, want %q", test.expr, f.GetName(), test.name)
+		}
+	}
+}
+
+func TestLiteralComparisons(t *testing.T) {
+	row := map[string]interface{}{"n": 3.0, "flag": true, "s": "3"}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"n = 3", true},
+		{"n = 3.0", true},
+		{"n > 2.5", true},
+		{"n < 1e1", true},
+		{"flag = true", true},
+		{"flag = false", false},
+		{"flag != false", true},
+		{`s = "3"`, true},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+}
+
+func TestNullLogic(t *testing.T) {
+	row := map[string]interface{}{"a": 1.0, "coupon": "", "n": nil, "exists": 2.0, "is": nil}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"missing = 1", false},
+		{"missing != 1", false},
+		{"NOT missing = 1", false},
+		{"NOT NOT missing = 1", false},
+		{"missing > 0 OR a = 1", true},
+		{"NOT (missing > 0 AND a = 2)", true},
+		{"NOT (missing > 0 OR a = 2)", false},
+		{"missing = 0", false},
+		{`coupon = ""`, true},
+		{"coupon IS NULL", false},
+		{"missing IS NULL", true},
+		{"n IS NULL", true},
+		{"missing IS NOT NULL", false},
+		{"a IS NOT NULL", true},
+		{"a + missing IS NULL", true},
+		{"missing = null", true},
+		{"a != null", true},
+		{"EXISTS(n)", true},
+		{"EXISTS(missing)", false},
+		{"NOT EXISTS(missing) AND a = 1", true},
+		{"exists = 2", true},
+		{"exists + 1 = 3", true},
+		{"is IS NULL", true},
+		{"EXISTS(is)", true},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+
+	if err := parseError("MAP is, exists AS is_set WHERE is IS NOT NULL"); err != nil {
+		t.Errorf("IS and EXISTS as names: %v", err)
+	}
+	for _, cond := range []string{"a IS 1", "a IS NOT", "EXISTS(a", "EXISTS(1)", "EXISTS()"} {
+		if err := parseError("MAP a WHERE " + cond); err == nil {
+			t.Errorf("%s: expected an error", cond)
+		}
+	}
+}
+
+func TestInList(t *testing.T) {
+	row := map[string]interface{}{
+		"event": "signup",
+		"n":     1.0,
+		"s":     "1",
+		"tags":  []interface{}{"a", "b", 2.0},
+		"holes": []interface{}{"a", nil},
+		"null":  nil,
+	}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{`event IN ("signup", "purchase")`, true},
+		{`event IN ("purchase")`, false},
+		{`event NOT IN ("purchase", "upgrade")`, true},
+		{`NOT event IN ("signup")`, false},
+		{"n IN (1, 2)", true},
+		{"n IN (1.0)", true},
+		{`n IN ("1")`, false},
+		{"s IN (1)", false},
+		{`s IN ("1")`, true},
+		// A value not in a list holding a null is unknown, as is a null.
+		{`event IN ("purchase", null)`, false},
+		{`event NOT IN ("purchase", null)`, false},
+		{`event IN ("signup", null)`, true},
+		{`null IN ("a")`, false},
+		{`null NOT IN ("a")`, false},
+		{`missing NOT IN ("a")`, false},
+		{"n + 1 IN (2, 3)", true},
+		{`"b" IN tags`, true},
+		{"2 IN tags", true},
+		{`"c" IN tags`, false},
+		{`"c" NOT IN tags`, true},
+		{`"a" IN holes`, true},
+		{`"c" NOT IN holes`, false},
+		{`"a" IN missing`, false},
+		{`event IN ("signup") AND n IN (1)`, true},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+
+	items := make([]string, 5000)
+	for i := range items {
+		items[i] = fmt.Sprintf(`"e%d"`, i)
+	}
+	big := parseWhere(t, "event IN ("+strings.Join(items, ", ")+", \"signup\")")
+	if !evalCondition(testEnv, row, big) {
+		t.Errorf("large list: got false, want true")
+	}
+
+	for _, cond := range []string{"a IN ()", "a IN (b)", "a IN (1,", "a IN (1 2)", "a NOT 1"} {
+		if err := parseError("MAP a WHERE " + cond); err == nil {
+			t.Errorf("%s: expected an error", cond)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	row := map[string]interface{}{
+		"path":  "/blog/2024/go-tips",
+		"ref":   "https://News.Example.com/a?b=1",
+		"code":  "100%_done",
+		"multi": "line one\nline two",
+		"n":     42.0,
+	}
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{`path LIKE "/blog/%"`, true},
+		{`path LIKE "/blog"`, false},
+		{`path LIKE "%tips"`, true},
+		{`path LIKE "/blog/____/%"`, true},
+		{`path LIKE "/BLOG/%"`, false},
+		{`path ILIKE "/BLOG/%"`, true},
+		{`path NOT LIKE "/docs/%"`, true},
+		{`path LIKE "/blog.2024%"`, false},
+		{`code LIKE "100\\%\\_done"`, true},
+		{`code LIKE "100\\%"`, false},
+		{`code LIKE "100%"`, true},
+		{`"1005done" LIKE "100\\%_done"`, false},
+		{`multi LIKE "line%two"`, true},
+		{`path MATCHES "^/blog/[0-9]{4}/"`, true},
+		{`path MATCHES "docs"`, false},
+		{`path NOT MATCHES "docs"`, true},
+		{`url_host(ref) = "News.Example.com"`, true},
+		{`lower(url_host(ref)) LIKE "%.example.com"`, true},
+		{`missing LIKE "%"`, false},
+		{`missing NOT LIKE "%"`, false},
+		{`n LIKE "4%"`, true},
+	}
+	for _, test := range tests {
+		if got := evalCondition(testEnv, row, parseWhere(t, test.cond)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.cond, got, test.want)
+		}
+	}
+
+	for _, cond := range []string{`path LIKE x`, `path MATCHES "("`, `path NOT "a"`, `path LIKE`} {
+		if err := parseError("MAP path WHERE " + cond); err == nil {
+			t.Errorf("%s: expected an error", cond)
+		}
+	}
+	if err := parseError("MAP like, matches AS ilike WHERE like LIKE 'a%'"); err != nil {
+		t.Errorf("LIKE, ILIKE and MATCHES as names: %v", err)
+	}
+}
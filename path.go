@@ -0,0 +1,70 @@
+package gofigure
+
+import (
+	"strconv"
+	"strings"
+)
+
+// lookup resolves a property path such as "user.plan", "items[0].sku" or
+// "context.device.os" against a decoded event. A key matching the whole path
+// takes precedence, so flat keys containing dots keep working. Missing
+// intermediate objects, out of range indexes and type mismatches resolve to
+// nil, false.
+func lookup(data map[string]interface{}, path string) (interface{}, bool) {
+	if val, ok := data[path]; ok {
+		return val, true
+	} else if !strings.ContainsAny(path, ".[") {
+		return nil, false
+	}
+
+	var cur interface{} = data
+	for _, segment := range splitPath(path) {
+		if index, ok := segment.(int); ok {
+			list, ok := cur.([]interface{})
+			if !ok || index < 0 || index >= len(list) {
+				return nil, false
+			}
+			cur = list[index]
+		} else {
+			obj, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if cur, ok = obj[segment.(string)]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return cur, true
+}
+
+// splitPath splits a property path into string keys and int list indexes.
+// A bracket that doesn't hold an index is kept as part of the key.
+func splitPath(path string) []interface{} {
+	segments := make([]interface{}, 0)
+	for _, part := range strings.Split(path, ".") {
+		for {
+			open := strings.IndexByte(part, '[')
+			if open < 0 {
+				break
+			}
+			end := strings.IndexByte(part[open:], ']')
+			if end < 0 {
+				break
+			}
+			index, err := strconv.Atoi(part[open+1 : open+end])
+			if err != nil {
+				break
+			}
+			if open > 0 {
+				segments = append(segments, part[:open])
+			}
+			segments = append(segments, index)
+			part = part[open+end+1:]
+		}
+		if part != "" {
+			segments = append(segments, part)
+		}
+	}
+	return segments
+}
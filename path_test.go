@@ -0,0 +1,68 @@
+package gofigure
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	var event map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"user": {"plan": "pro", "tags": ["a", "b"]},
+		"items": [{"sku": "x1", "qty": 2}, {"sku": "x2"}],
+		"matrix": [[1, 2], [3, 4]],
+		"a.b": "flat",
+		"a": {"b": "nested"},
+		"m[x]": 1,
+		"n": null
+	}`), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+		ok   bool
+	}{
+		{"user.plan", "pro", true},
+		{"user.tags[1]", "b", true},
+		{"items[0].sku", "x1", true},
+		{"items[1].qty", nil, false},
+		{"items[2].sku", nil, false},
+		{"items[-1]", nil, false},
+		{"matrix[1][0]", 3.0, true},
+		{"a.b", "flat", true},
+		{"m[x]", 1.0, true},
+		{"n", nil, true},
+		{"n.x", nil, false},
+		{"user.plan.x", nil, false},
+		{"items.sku", nil, false},
+		{"missing", nil, false},
+	}
+	for _, test := range tests {
+		got, ok := lookup(event, test.path)
+		if ok != test.ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestPathFields(t *testing.T) {
+	var event map[string]interface{}
+	json.Unmarshal([]byte(`{"order": {"total": 10, "lines": [{"price": 4}, {"price": 6}]}}`), &event)
+	tests := []struct {
+		expr string
+		want interface{}
+	}{
+		{"order.total * 2", 20.0},
+		{"order.lines[1].price - order.lines[0].price", 2.0},
+		{"order.lines[2].price", nil},
+	}
+	for _, test := range tests {
+		if got := evalField(testEnv, event, parseExprField(t, test.expr)); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
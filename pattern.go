@@ -0,0 +1,49 @@
+package gofigure
+
+import (
+	"regexp"
+	"strings"
+)
+
+// compilePattern compiles the pattern of a LIKE, ILIKE or MATCHES operator.
+func compilePattern(op Token, pattern string) (*regexp.Regexp, error) {
+	switch op {
+	case LIKE:
+		return regexp.Compile(likeToRegexp(pattern, false))
+	case ILIKE:
+		return regexp.Compile(likeToRegexp(pattern, true))
+	}
+	return regexp.Compile(pattern)
+}
+
+// likeToRegexp translates a LIKE pattern into an anchored regular
+// expression. % matches any run of characters, _ any single character and
+// a backslash escapes the character after it.
+func likeToRegexp(pattern string, fold bool) string {
+	var b strings.Builder
+	b.WriteString("(?s)")
+	if fold {
+		b.WriteString("(?i)")
+	}
+	b.WriteString("^")
+	escaped := false
+	for _, ch := range pattern {
+		if escaped {
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+			escaped = false
+		} else if ch == '\\' {
+			escaped = true
+		} else if ch == '%' {
+			b.WriteString(".*")
+		} else if ch == '_' {
+			b.WriteString(".")
+		} else {
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	if escaped {
+		b.WriteString(regexp.QuoteMeta(`\`))
+	}
+	b.WriteString("$")
+	return b.String()
+}
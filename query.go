@@ -1,339 +1,634 @@
-package main
-
-// Go provides a `flag` package supporting basic
-// command-line flag parsing. We'll use this package to
-// implement our example command-line program.
-import "bytes"
-import "bufio"
-import "encoding/json"
-import "flag"
-import "fmt"
-import "log"
-import "os"
-import "path/filepath"
-import "reflect"
-import "time"
-
-var mapped []map[string]interface{} = make([]map[string]interface{}, 0)
-var reduced map[string]map[string]interface{} = make(map[string]map[string]interface{})
-
-func pluck(prop string, collection []interface{}) []interface{} {
-	var res []interface{} = make([]interface{}, 0)
-	for _, entry := range collection {
-		if mapVal, ok := entry.(map[string]interface{}); ok {
-			if val, ok := mapVal[prop]; ok {
-				res = append(res, val)
-			}
-		}
-	}
-	return res
+package gofigure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query is a parsed MAP/REDUCE query. A Query is not modified by Execute, so
+// it may be executed any number of times, concurrently.
+type Query struct {
+	Map *Statement
+	// Reduce is nil for queries without a REDUCE statement.
+	Reduce *ReduceStatement
+	// Explain is set for queries prefixed with EXPLAIN, which are planned
+	// but not run, their result being the plan.
+	Explain bool
+	// Analyze is set for queries prefixed with ANALYZE, whose results are
+	// marshalled with their Stats.
+	Analyze bool
 }
 
-func _eval(event map[string]interface{}, condition Condition) bool {
-	if condition.left.GetType() == TYPE_PROPERTY {
-		condition.left = evalPropertyNode(event, condition.left)
+// Parse parses a MAP/REDUCE query, optionally prefixed with EXPLAIN or
+// ANALYZE.
+func Parse(query string) (*Query, error) {
+	p := NewParser(strings.NewReader(query))
+	ms, rs, err := p.Parse()
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{Map: ms, Explain: p.prefix == "EXPLAIN", Analyze: p.prefix == "ANALYZE"}
+	if len(rs.Keys) > 0 {
+		q.Reduce = rs
 	}
+	return q, nil
+}
+
+// TimeRange is the [Start, End) interval of event timestamps a query covers,
+// to the second. A zero End means now.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
 
-	if condition.right.GetType() == TYPE_PROPERTY {
-		condition.right = evalPropertyNode(event, condition.right)
+// Result holds the output of a query. It marshals to JSON as a list of rows,
+// or for unordered REDUCE queries as an object of groups nested by key. For
+// ANALYZE queries that is wrapped as {"result": ..., "stats": ...}, and for
+// EXPLAIN queries it is the plan.
+type Result struct {
+	// Rows holds the mapped rows, or the reduced rows for REDUCE queries with
+	// ORDER BY or LIMIT.
+	Rows []map[string]interface{}
+	// Groups holds the reduced groups for REDUCE queries without ORDER BY or
+	// LIMIT, nested one level per REDUCE key.
+	Groups map[string]interface{}
+	// Plan is the plan of an EXPLAIN query, which has no rows or groups.
+	Plan *Plan
+	// Stats counts the work the query did.
+	Stats Stats
+	// analyze includes Stats in the JSON.
+	analyze bool
+}
+
+func (r *Result) MarshalJSON() ([]byte, error) {
+	if r.Plan != nil {
+		return json.Marshal(r.Plan)
+	}
+	var output interface{} = r.Rows
+	if r.Groups != nil {
+		output = r.Groups
 	}
+	if r.analyze {
+		return json.Marshal(struct {
+			Result interface{} `json:"result"`
+			Stats  Stats       `json:"stats"`
+		}{output, r.Stats})
+	}
+	return json.Marshal(output)
+}
+
+// Engine executes queries. The zero value is ready to use.
+type Engine struct {
+	// Location is the timezone time bucketing functions truncate in. Nil
+	// means UTC.
+	Location *time.Location
+	// Workers is how many files, or chunks of large files, are scanned at
+	// once. Zero means one per CPU.
+	Workers int
+	// MemoryLimit is roughly how many bytes of REDUCE groups are kept in
+	// memory before they are spilled to temporary files, to be merged back
+	// as the groups are reduced. The groups of the files or chunks being
+	// scanned come on top of it. Zero means no limit.
+	MemoryLimit int64
+	// TempDir is where spill files are written. Empty means os.TempDir().
+	TempDir string
+}
+
+// Execute runs q over the events in store that fall in tr, using a zero
+// Engine.
+func Execute(ctx context.Context, store Store, q *Query, tr TimeRange) (*Result, error) {
+	return (&Engine{}).Execute(ctx, store, q, tr)
+}
 
-	if condition.left.GetType() == TYPE_NIL {
-		condition.left.SetType(condition.right.GetType())
+// Execute runs q over the events in store that fall in tr. If ctx is done
+// before the query finishes, it returns a *CanceledError. EXPLAIN queries
+// only select the files to scan, returning the plan.
+func (engine *Engine) Execute(ctx context.Context, store Store, q *Query, tr TimeRange) (*Result, error) {
+	if q == nil || q.Map == nil {
+		return nil, errors.New("no query to execute")
+	}
+	if tr.End.IsZero() {
+		tr.End = time.Now()
 	}
 
-	if condition.right.GetType() == TYPE_NIL {
-		condition.right.SetType(condition.left.GetType())
+	start := time.Now()
+	x := newExecution(engine, q)
+	defer x.closeSpill()
+	files, err := store.Files(tr)
+	if err != nil {
+		return nil, err
 	}
+	x.progress.files = files
+	x.progress.timings.Files = time.Since(start)
 
-	var l *Field
-	if val, ok := condition.left.(*Field); ok {
-		l = val
-	} else {
-		panic("left field is not a field")
+	workers := engine.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if q.Explain {
+		return &Result{Plan: newPlan(q, tr, files, workers)}, nil
 	}
 
-	var r *Field
-	if val, ok := condition.right.(*Field); ok {
-		r = val
-	} else {
-		panic("left field is not a field")
-	}
-
-	op := condition.op
-	switch l.GetType() {
-	case TYPE_INT:
-		left := l.IntVal
-		switch r.Type {
-		case TYPE_INT:
-			right := r.IntVal
-			return compareIntToInt(left, right, op)
-		case TYPE_FLOAT:
-			right := r.FloatVal
-			return compareIntToFloat(left, right, op)
-		case TYPE_STRING:
-			right := r.StringVal
-			return compareIntToString(left, right, op)
-		}
-	case TYPE_FLOAT:
-		left := l.FloatVal
-		switch r.Type {
-		case TYPE_INT:
-			right := r.IntVal
-			return compareFloatToInt(left, right, op)
-		case TYPE_FLOAT:
-			right := r.FloatVal
-			return compareFloatToFloat(left, right, op)
-		case TYPE_STRING:
-			right := r.StringVal
-			return compareFloatToString(left, right, op)
+	within := &timeRange{start: tr.Start.Unix(), end: tr.End.Unix()}
+	phase := time.Now()
+	err = x.scan(ctx, store, files, within, workers)
+	x.progress.timings.Scan = time.Since(phase)
+	var result *Result
+	if err == nil {
+		phase = time.Now()
+		result, err = x.result(ctx)
+		x.progress.timings.Reduce = time.Since(phase)
+		if err == nil {
+			// Reducing only checks ctx every so many groups.
+			err = ctx.Err()
 		}
-	case TYPE_STRING:
-		left := l.StringVal
-		switch r.Type {
-		case TYPE_INT:
-			right := r.IntVal
-			return compareStringToInt(left, right, op)
-		case TYPE_FLOAT:
-			right := r.FloatVal
-			return compareStringToFloat(left, right, op)
-		case TYPE_STRING:
-			right := r.StringVal
-			return compareStringToString(left, right, op)
+	}
+	x.progress.timings.Total = time.Since(start)
+	if err != nil {
+		// Errors after ctx is done are most likely caused by it.
+		if ctx.Err() != nil {
+			return nil, &CanceledError{Err: ctx.Err(), Stats: x.stats()}
 		}
+		return nil, err
 	}
-	panic(fmt.Sprintf("Type %d not supported\n", l.GetType()))
+	result.Stats = x.stats()
+	result.analyze = q.Analyze
+	return result, nil
 }
 
-// could probably remove this in favor of evalField
-func evalPropertyNode(event map[string]interface{}, node IField) *Field {
-	var f *Field
-	if field, ok := node.(*Field); ok {
-		f = field
-	} else {
-		panic("node is not Field")
-	}
-
-	val := event[f.StringVal]
-	if val == nil {
-		return &Field{Type: TYPE_NIL}
-	} else if intVal, ok := val.(int); ok {
-		return &Field{Type: TYPE_INT, IntVal: intVal}
-	} else if floatVal, ok := val.(float64); ok {
-		return &Field{Type: TYPE_FLOAT, FloatVal: floatVal}
-	} else if strVal, ok := val.(string); ok {
-		return &Field{Type: TYPE_STRING, StringVal: strVal}
-	} else if listVal, ok := val.([]interface{}); ok {
-		return &Field{Type: TYPE_LIST, ListVal: listVal}
-	} else {
-		fmt.Println("Property value didn't match any types")
-		return &Field{}
+// execution holds the state of a single run of a query.
+type execution struct {
+	env    *env
+	q      *Query
+	mapped []map[string]interface{}
+	groups map[string]*group
+	// sorter orders the output rows: the mapped rows of a query without a
+	// REDUCE, or else the reduced groups, once the scan is done.
+	sorter *rowSorter
+	// progress is shared with the execution's forks.
+	progress *progress
+
+	// memoryLimit, tempDir, groupBytes and runs are used to spill groups to
+	// disk. groupBytes estimates the size of groups.
+	memoryLimit int64
+	tempDir     string
+	groupBytes  int64
+	runs        []*spillRun
+}
+
+func newExecution(engine *Engine, q *Query) *execution {
+	x := &execution{
+		env:      &env{loc: time.UTC},
+		q:        q,
+		mapped:   make([]map[string]interface{}, 0),
+		groups:   make(map[string]*group),
+		progress: &progress{},
+
+		memoryLimit: engine.MemoryLimit,
+		tempDir:     engine.TempDir,
+	}
+	if engine.Location != nil {
+		x.env.loc = engine.Location
 	}
+	if q.Reduce == nil && (len(q.Map.OrderBy) > 0 || q.Map.Limit > 0) {
+		x.sorter = newRowSorter(x.env, q.Map.OrderBy, q.Map.Limit)
+	}
+	return x
 }
 
-func evalField(event_json map[string]interface{}, field IField) interface{} {
-	if f, ok := field.(*Field); ok {
-		if _, ok := event_json[field.GetName()]; ok {
-			return event_json[f.GetName()]
-		} else {
-			// fmt.Printf("No field %s in row %s\n", field.GetName(), event_json)
-			return nil
-		}
-	} else if itr, ok := field.(*FieldItr); ok {
-		collection := evalField(event_json, itr.Collection)
-		if collection != nil {
-			if collection, ok := collection.([]interface{}); ok {
-				return pluck(itr.GetName(), collection)
-			} else {
-				panic(fmt.Sprintf("Expected evalField to return a list, instead got %s (type %s)", collection, reflect.TypeOf(collection)))
-			}
-		}
-	} else if exp, ok := field.(*BinaryExpr); ok {
-		left := evalField(event_json, exp.Left)
-		right := evalField(event_json, exp.Right)
-		switch exp.Operator {
-		case MULTIPLY:
-			var l float64 = 0
-			var r float64 = 0
-			if lInt, ok := left.(int); ok {
-				l = float64(lInt)
-			} else if lFloat, ok := left.(float64); ok {
-				l = lFloat
-			} else {
-				// fmt.Printf("%s is not an int or float", left)
-			}
+// fork returns an empty execution of the same query, to scan part of the
+// data into before it is merged back.
+func (x *execution) fork() *execution {
+	part := &execution{
+		env:      x.env,
+		q:        x.q,
+		mapped:   make([]map[string]interface{}, 0),
+		groups:   make(map[string]*group),
+		progress: x.progress,
+	}
+	if x.sorter != nil {
+		part.sorter = newRowSorter(x.env, x.sorter.order, x.sorter.limit)
+	}
+	return part
+}
 
-			if rInt, ok := right.(int); ok {
-				r = float64(rInt)
-			} else if rFloat, ok := right.(float64); ok {
-				r = rFloat
-			} else {
-				// fmt.Printf("%s is not an int or float", right)
+// merge adds the output of part, which scanned the data following what x
+// has, as if x had scanned it too. If x's groups outgrow the memory limit
+// they are spilled.
+func (x *execution) merge(part *execution) error {
+	if x.q.Reduce != nil {
+		for id, g := range part.groups {
+			mine, ok := x.groups[id]
+			if !ok {
+				x.groups[id] = g
+				x.groupBytes += int64(g.size(id))
+				continue
 			}
-			return l * r
-		}
-	} else if agg, ok := field.(*Aggregator); ok {
-		if collection, ok := evalField(event_json, agg.Target).([]interface{}); ok {
-			switch agg.Method {
-			case AGG_SUM:
-				var sum float64 = 0
-				for _, entry := range collection {
-					if entryInt, ok := entry.(int); ok {
-						sum += float64(entryInt)
-					} else if entryFloat, ok := entry.(float64); ok {
-						sum += entryFloat
-					} else {
-						// fmt.Printf("%s is not an int or float", entry)
-					}
-				}
-				return sum
-			case AGG_COUNT:
-				return len(collection)
-			default:
-				panic(fmt.Sprintf("No aggregate method found for %d", agg.Method))
+			x.groupBytes -= int64(mine.size(id))
+			mine.count += g.count
+			for i, state := range mine.states {
+				state.merge(g.states[i])
 			}
-		} else {
-			// fmt.Printf("Can't aggregate %s because it's not a list. val: %s\n", agg.Target.GetName(), event_json)
+			x.groupBytes += int64(mine.size(id))
+		}
+		if x.memoryLimit > 0 && x.groupBytes > x.memoryLimit {
+			return x.spill()
 		}
+	} else if x.sorter != nil {
+		x.sorter.merge(part.sorter)
+	} else {
+		x.mapped = append(x.mapped, part.mapped...)
 	}
 	return nil
 }
 
-func _map(event string, mapper Statement) {
+// whereScope returns the data a MAP WHERE clause is evaluated against: the
+// event with the computed and aliased columns of row laid over it, so
+// conditions can use both event properties and MAP fields.
+func whereScope(event map[string]interface{}, row map[string]interface{}, mapper *Statement) map[string]interface{} {
+	for _, field := range mapper.Fields {
+		if f, ok := field.(*Field); ok && f.Type == TYPE_PROPERTY && f.StringVal == f.Name {
+			continue
+		}
+		event[field.GetName()] = row[field.GetName()]
+	}
+	return event
+}
+
+// timeRange is the [start, end) interval of event timestamps, in seconds, a
+// query covers.
+type timeRange struct {
+	start int64
+	end   int64
+}
+
+// contains reports whether the event's _ts falls in the range. Events
+// without a numeric _ts are outside every range.
+func (r *timeRange) contains(event map[string]interface{}) bool {
+	ts, ok := toFloat(event["_ts"])
+	return ok && float64(r.start) <= ts && ts < float64(r.end)
+}
+
+// mapOutcome is what became of an event given to _map.
+type mapOutcome int
+
+const (
+	// mapKept events passed the MAP condition.
+	mapKept mapOutcome = iota
+	// mapSkipped events were outside the time range or failed the condition.
+	mapSkipped
+	// mapInvalid events weren't valid JSON.
+	mapInvalid
+)
+
+// _map maps a single event. If within is non-nil, events whose _ts falls
+// outside it are skipped.
+func (x *execution) _map(event string, within *timeRange) mapOutcome {
+	mapper := x.q.Map
 	var event_json map[string]interface{}
 	if err := json.Unmarshal([]byte(event), &event_json); err == nil {
+		if within != nil && !within.contains(event_json) {
+			return mapSkipped
+		}
 		var row map[string]interface{} = make(map[string]interface{})
 		for _, field := range mapper.Fields {
-			row[field.GetName()] = evalField(event_json, field)
+			row[field.GetName()] = evalField(x.env, event_json, field)
 		}
 
-		var match bool = true
-		for _, condition := range mapper.Conditions {
-			if !_eval(row, condition) {
-				match = false
+		if mapper.Condition == nil || evalCondition(x.env, whereScope(event_json, row, mapper), mapper.Condition) {
+			if x.q.Reduce != nil {
+				x.accumulate(row)
+			} else if x.sorter != nil {
+				x.sorter.Add(row)
+			} else {
+				x.mapped = append(x.mapped, row)
 			}
+			return mapKept
 		}
-		if match {
-			mapped = append(mapped, row)
-		}
+		return mapSkipped
 	}
+	return mapInvalid
 }
 
-func _reduce(reducer ReduceStatement) {
-	for _, row := range mapped {
-		key_val, ok := row[reducer.Key].(string)
-		if ok {
-			if _, ok := reduced[key_val]; !ok {
-				reduced[key_val] = make(map[string]interface{})
-				reduced[key_val]["_count"] = 0
-			}
+// group holds the aggregate states of a single REDUCE key combination,
+// and once reduced, its output columns.
+type group struct {
+	keys   []interface{}
+	count  int
+	states []aggState
+	data   map[string]interface{}
+	// dropped marks a reduced group HAVING filtered out, kept until
+	// gap-filling has seen it.
+	dropped bool
+}
 
-			count := reduced[key_val]["_count"]
-			if countInt, ok := count.(int); ok {
-				countInt += 1
-				reduced[key_val]["_count"] = countInt
-			}
+func (x *execution) newGroup(keys []interface{}) *group {
+	g := &group{keys: keys, states: make([]aggState, len(x.q.Reduce.aggs))}
+	for i, agg := range x.q.Reduce.aggs {
+		g.states[i] = newAggState(agg.Method)
+	}
+	return g
+}
 
-			for field, val := range row {
-				if field != reducer.Key {
-					if _, ok := reduced[key_val][field]; !ok {
-						reduced[key_val][field] = make([]interface{}, 0)
-					}
-					if f, ok := reduced[key_val][field].([]interface{}); ok {
-						reduced[key_val][field] = append(f, val)
-					} else {
-						panic(fmt.Sprintf("field %s on key %s in reducer is not a list", field, key_val))
-					}
-				}
-			}
+// keyString formats a key value for use as a JSON object key. Numbers,
+// booleans and nil are named by their JSON text.
+func keyString(v interface{}) string {
+	if v == nil {
+		return "null"
+	} else if s, ok := v.(string); ok {
+		return s
+	} else if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	} else if i, ok := v.(int); ok {
+		return strconv.Itoa(i)
+	} else if b, ok := v.(bool); ok {
+		return strconv.FormatBool(b)
+	} else if str, err := json.Marshal(v); err == nil {
+		return string(str)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// groupID returns the id of the group for key values. Each value is tagged
+// with its type, so 1 and "1" or null and "null" are in different groups
+// while 3 and 3.0 share one.
+func groupID(keys []interface{}) string {
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		if key, ok := setKey(k); ok {
+			ids[i] = key
+		} else if k == nil {
+			ids[i] = "null"
+		} else if str, err := json.Marshal(k); err == nil {
+			ids[i] = "j:" + string(str)
+		} else {
+			ids[i] = fmt.Sprintf("v:%v", k)
 		}
 	}
+	return strings.Join(ids, "\x00")
+}
+
+// accumulate adds a mapped row to the aggregate states of its REDUCE group.
+func (x *execution) accumulate(row map[string]interface{}) {
+	reducer := x.q.Reduce
+	keys := make([]interface{}, len(reducer.Keys))
+	for i, k := range reducer.Keys {
+		keys[i] = evalField(x.env, row, k)
+	}
+	id := groupID(keys)
 
-	for key, data := range reduced {
-		for _, field := range reducer.GetFields() {
-			reduced[key][field.GetName()] = evalField(data, field)
+	g, ok := x.groups[id]
+	if !ok {
+		g = x.newGroup(keys)
+		x.groups[id] = g
+	}
+	g.count++
+	for i, agg := range reducer.aggs {
+		g.states[i].add(evalField(x.env, row, agg.Target))
+	}
+}
+
+// _reduce computes the REDUCE fields of every group from its aggregate
+// states, merging back spilled groups first, and drops the groups HAVING
+// filters out. It stops with ctx's error if ctx is done first.
+func (x *execution) _reduce(ctx context.Context) error {
+	if len(x.runs) > 0 {
+		if err := x.mergeSpilled(ctx); err != nil {
+			return err
 		}
+	} else {
+		x.progress.groups = len(x.groups)
+	}
+	if err := x.fillBuckets(ctx); err != nil {
+		return err
+	}
 
-		var match bool = true
-		for _, condition := range reducer.Conditions {
-			if !_eval(data, condition) {
-				match = false
+	n := 0
+	for id, g := range x.groups {
+		if n++; n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
 			}
 		}
-
-		if !match {
-			delete(reduced, key)
+		if g.data == nil && !x.reduceGroup(g) {
+			g.dropped = true
+		}
+		if g.dropped {
+			delete(x.groups, id)
 		}
 	}
+	return nil
 }
 
-func scanFile(file *os.File, mapper *Statement) {
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		_map(scanner.Text(), *mapper)
+// reduceGroup computes g's REDUCE fields and frees its aggregate states,
+// reporting whether HAVING keeps it.
+func (x *execution) reduceGroup(g *group) bool {
+	reducer := x.q.Reduce
+	scope := x.groupScope(g)
+	g.data = make(map[string]interface{}, len(reducer.Fields)+1)
+	g.data["_count"] = g.count
+	for i, field := range reducer.Fields {
+		val := evalField(x.env, scope, reducer.outputs[i])
+		scope[field.GetName()] = val
+		g.data[field.GetName()] = val
 	}
+	g.states = nil
 
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
-	}
+	return reducer.Having == nil || evalCondition(x.env, scope, reducer.Having)
+}
 
-	file.Close()
+// groupScope returns the columns the resolved REDUCE fields and HAVING are
+// evaluated against: the group's keys, _count and the results of its
+// aggregates. The REDUCE fields are added as they are computed.
+func (x *execution) groupScope(g *group) map[string]interface{} {
+	reducer := x.q.Reduce
+	scope := make(map[string]interface{}, len(reducer.Keys)+len(reducer.aggs)+len(reducer.Fields)+1)
+	scope["_count"] = g.count
+	for i, k := range reducer.Keys {
+		scope[k.GetName()] = g.keys[i]
+	}
+	for i, agg := range reducer.aggs {
+		scope[agg.GetName()] = g.states[i].result()
+	}
+	return scope
 }
 
-func main() {
-	queryPtr := flag.String("query", "", "Query to run. E.g. \"MAP field_1, field_2 REDUCE ON field_1\"")
-	startPtr := flag.Int64("start", 0, "Start date (in seconds)")
-	endPtr := flag.Int64("end", time.Now().Unix(), "End date (in seconds)")
-	flag.Parse()
-	startTm := time.Unix(*startPtr, 0)
-	endTm := time.Unix(*endPtr, 0)
-	startFile := GenerateFileName(startTm)
-	endFile := GenerateFileName(endTm)
-	dirname := "data" + string(filepath.Separator)
-
-	query := bytes.NewBufferString(*queryPtr)
-	p := NewParser(query)
-	mapper, reducer, err := p.Parse()
-	if err != nil {
-		panic(err)
+// fillBuckets adds empty groups for the buckets missing between the first
+// and last group when a REDUCE is keyed on a single time bucketing function,
+// so time series come back without gaps. It stops with ctx's error if ctx
+// is done first.
+func (x *execution) fillBuckets(ctx context.Context) error {
+	b := x.timeBucketKey()
+	if b == nil || len(x.groups) == 0 {
+		return nil
 	}
 
-	d, err := os.Open(dirname)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	var first, last float64
+	found := false
+	for _, g := range x.groups {
+		ts, ok := g.keys[0].(float64)
+		if !ok {
+			continue
+		}
+		if !found || ts < first {
+			first = ts
+		}
+		if !found || ts > last {
+			last = ts
+		}
+		found = true
+	}
+	if !found {
+		return nil
 	}
 
-	defer d.Close()
+	missing := make([]float64, 0)
+	n := 0
+	for t := time.Unix(int64(first), 0).In(x.env.loc); float64(t.Unix()) < last; {
+		if n++; n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if _, ok := x.groups[groupID([]interface{}{float64(t.Unix())})]; !ok {
+			missing = append(missing, float64(t.Unix()))
+		}
+		if len(missing) > maxFilledBuckets {
+			return nil
+		}
+		next := b.next(t)
+		if !next.After(t) {
+			panic(fmt.Sprintf("time bucket %s did not advance past %v", b.unit, t))
+		}
+		t = next
+	}
 
-	files, err := d.Readdir(-1)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for _, ts := range missing {
+		g := x.newGroup([]interface{}{ts})
+		x.groups[groupID(g.keys)] = g
 	}
+	return nil
+}
 
-	for _, f := range files {
-		if startFile <= f.Name() && f.Name() <= endFile {
-			if file, err := os.Open(dirname + f.Name()); err == nil {
-				scanFile(file, mapper)
-			} else {
-				log.Fatal(err)
+// timeBucketKey returns the time bucket of a REDUCE keyed on a single time
+// bucketing function, or nil. The key may also name a MAP field computed by
+// one, as in "MAP hour(_ts) AS h ... ON h".
+func (x *execution) timeBucketKey() *timeBucket {
+	reducer := x.q.Reduce
+	if len(reducer.Keys) != 1 {
+		return nil
+	}
+	key := reducer.Keys[0]
+	if leaf, ok := key.(*Field); ok && leaf.Type == TYPE_PROPERTY {
+		for _, f := range x.q.Map.Fields {
+			if f.GetName() == leaf.StringVal {
+				key = f
+				break
 			}
 		}
 	}
+	call, ok := key.(*FuncCall)
+	if !ok || functions[call.Func].bucket == nil {
+		return nil
+	}
+	return functions[call.Func].bucket(call.Args)
+}
 
-	if reducer.Key == "" {
-		if resultStr, err := json.Marshal(mapped); err != nil {
-			panic(err)
-		} else {
-			fmt.Printf("%s", resultStr)
+// reducedResult nests the reduced groups by key, one level per REDUCE key.
+// Groups are named in id order, so when values such as 1 and "1" would
+// share a name at one level, the first keeps it and the others are named by
+// their JSON text instead.
+func (x *execution) reducedResult() map[string]interface{} {
+	ids := make([]string, 0, len(x.groups))
+	for id := range x.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := make(map[string]interface{})
+	// names maps the ids of the key prefixes met so far to their names.
+	names := make(map[string]string)
+	for _, id := range ids {
+		g := x.groups[id]
+		node := result
+		for i, k := range g.keys {
+			prefix := groupID(g.keys[:i+1])
+			name, ok := names[prefix]
+			if !ok {
+				name = keyString(k)
+				if _, taken := node[name]; taken {
+					str, _ := json.Marshal(k)
+					name = string(str)
+				}
+				names[prefix] = name
+			}
+			if i == len(g.keys)-1 {
+				node[name] = g.data
+				break
+			}
+			child, ok := node[name].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				node[name] = child
+			}
+			node = child
 		}
-	} else {
-		_reduce(*reducer)
-		if resultStr, err := json.Marshal(reduced); err != nil {
-			panic(err)
-		} else {
-			fmt.Printf("%s", resultStr)
+	}
+	return result
+}
+
+// reducedRows returns the reduced groups as an ordered list of rows, each
+// holding its key values under the key names alongside the reduced fields.
+// Groups merged back from disk may already have been added to x.sorter.
+func (x *execution) reducedRows() []map[string]interface{} {
+	ids := make([]string, 0, len(x.groups))
+	for id := range x.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		x.sorter.Add(x.groupRow(x.groups[id]))
+		delete(x.groups, id)
+	}
+	return x.sorter.Rows()
+}
+
+// groupRow returns g's reduced fields with its key values under the key
+// names, reusing g.data.
+func (x *execution) groupRow(g *group) map[string]interface{} {
+	row := g.data
+	for i, k := range x.q.Reduce.Keys {
+		row[k.GetName()] = g.keys[i]
+	}
+	return row
+}
+
+// result computes the reduced groups if needed and returns the query's output.
+func (x *execution) result(ctx context.Context) (*Result, error) {
+	if x.q.Reduce == nil {
+		if x.sorter != nil {
+			return &Result{Rows: x.sorter.Rows()}, nil
 		}
+		return &Result{Rows: x.mapped}, nil
+	}
+
+	reducer := x.q.Reduce
+	if len(reducer.OrderBy) > 0 || reducer.Limit > 0 {
+		x.sorter = newRowSorter(x.env, reducer.OrderBy, reducer.Limit)
+	}
+	if err := x._reduce(ctx); err != nil {
+		return nil, err
+	}
+	if x.sorter != nil {
+		return &Result{Rows: x.reducedRows()}, nil
 	}
+	return &Result{Groups: x.reducedResult()}, nil
 }
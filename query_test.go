@@ -0,0 +1,463 @@
+package gofigure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore writes perDay events a second apart on each of days days into a
+// DirStore, returning it and the range covering them.
+func testStore(t *testing.T, days int, perDay int) (Store, TimeRange) {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := &Writer{Dir: t.TempDir()}
+	for d := 0; d < days; d++ {
+		for i := 0; i < perDay; i++ {
+			ts := start.AddDate(0, 0, d).Add(time.Duration(i) * time.Second)
+			event := fmt.Sprintf(`{"_ts":%d,"user":"u%d","country":"c%d","revenue":%d}`, ts.Unix(), i, i%7, i%10)
+			if err := w.Write(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return DirStore{Dir: w.Dir}, TimeRange{Start: start, End: start.AddDate(0, 0, days)}
+}
+
+// reduceRows runs query over the events rows with engine, returning the
+// execution once reduced, ready for reducedResult or reducedRows.
+func reduceRows(t *testing.T, engine *Engine, query string, rows []map[string]interface{}) *execution {
+	t.Helper()
+	q, err := Parse(query)
+	if err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	x := newExecution(engine, q)
+	for _, event := range rows {
+		row := make(map[string]interface{})
+		for _, field := range q.Map.Fields {
+			row[field.GetName()] = evalField(x.env, event, field)
+		}
+		x.accumulate(row)
+	}
+	x.sorter = newRowSorter(x.env, q.Reduce.OrderBy, q.Reduce.Limit)
+	if err := x._reduce(context.Background()); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return x
+}
+
+func TestReduceKeyTypes(t *testing.T) {
+	keys := []interface{}{1.0, "1", nil, "null", true, "true", 1.0}
+	rows := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		rows[i] = map[string]interface{}{"k": k, "v": float64(int(1) << i)}
+	}
+	result := reduceRows(t, &Engine{}, "MAP k, v REDUCE SUM v ON k", rows).reducedResult()
+
+	want := map[string]float64{
+		"1":      65,
+		`"1"`:    2,
+		"null":   4,
+		`"null"`: 8,
+		"true":   16,
+		`"true"`: 32,
+	}
+	if len(result) != len(want) {
+		t.Errorf("got %d groups, want %d: %v", len(result), len(want), result)
+	}
+	for name, sum := range want {
+		g, _ := result[name].(map[string]interface{})
+		if g == nil || g["SUM v"] != sum {
+			t.Errorf("group %s: got %v, want SUM v %v", name, g, sum)
+		}
+	}
+}
+
+func TestReduceMultipleKeys(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"country": "US", "plan": "pro", "v": 1.0},
+		{"country": "US", "plan": "free", "v": 2.0},
+		{"country": "US", "plan": "pro", "v": 4.0},
+		{"country": "CA", "plan": "pro", "v": 8.0},
+	}
+	result := reduceRows(t, &Engine{}, "MAP country, plan, v REDUCE SUM v ON country, plan", rows).reducedResult()
+	tests := []struct {
+		country, plan string
+		sum           float64
+		count         int
+	}{
+		{"US", "pro", 5, 2},
+		{"US", "free", 2, 1},
+		{"CA", "pro", 8, 1},
+	}
+	for _, test := range tests {
+		byPlan, _ := result[test.country].(map[string]interface{})
+		g, _ := byPlan[test.plan].(map[string]interface{})
+		if g == nil || g["SUM v"] != test.sum || g["_count"] != test.count {
+			t.Errorf("%s, %s: got %v, want SUM v %v and _count %d", test.country, test.plan, g, test.sum, test.count)
+		}
+	}
+
+	result = reduceRows(t, &Engine{}, "MAP v REDUCE COUNT v ON v * 2 - 1", rows).reducedResult()
+	for _, name := range []string{"1", "3", "7", "15"} {
+		if _, ok := result[name]; !ok {
+			t.Errorf("expression key: no group %s in %v", name, result)
+		}
+	}
+}
+
+func TestReduceColumnErrors(t *testing.T) {
+	for _, query := range []string{
+		"MAP a REDUCE SUM b ON a",
+		"MAP a REDUCE SUM a ON x",
+		"MAP a REDUCE SUM a ON a + x",
+		"MAP a REDUCE SUM a / COUNT b ON a",
+		"MAP a AS b REDUCE SUM a ON b",
+	} {
+		if err := parseError(query); err == nil {
+			t.Errorf("%s: expected an error", query)
+		}
+	}
+	for _, query := range []string{
+		"MAP a AS b REDUCE SUM b ON b",
+		"MAP user, v REDUCE SUM v ON user.plan",
+		"MAP a REDUCE _count, COUNT a ON a",
+	} {
+		if err := parseError(query); err != nil {
+			t.Errorf("%s: %v", query, err)
+		}
+	}
+}
+
+func TestReduceOrderLimit(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"a": "x", "v": 1.0},
+		{"a": "y", "v": 5.0},
+		{"a": "z", "v": 3.0},
+		{"a": "y", "v": 1.0},
+		{"a": "w", "v": 3.0},
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"MAP a, v REDUCE SUM v ON a ORDER BY SUM v DESC", "y w z x"},
+		{"MAP a, v REDUCE SUM v ON a ORDER BY SUM v DESC LIMIT 2", "y w"},
+		{"MAP a, v REDUCE SUM v ON a ORDER BY SUM v, a DESC", "x z w y"},
+		{"MAP a, v REDUCE SUM v ON a ORDER BY _count DESC, a LIMIT 3", "y w x"},
+		{"MAP a, v REDUCE SUM v AS total ON a ORDER BY total LIMIT 1", "x"},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, row := range reduceRows(t, &Engine{}, test.query, rows).reducedRows() {
+			got = append(got, row["a"].(string))
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestRowSorter(t *testing.T) {
+	order := []OrderBy{
+		{Field: &Field{Type: TYPE_PROPERTY, Name: "v", StringVal: "v"}, Desc: true},
+	}
+	values := []interface{}{2.0, nil, 5.0, 1.0, 5.0, 3.0}
+	for _, limit := range []int{0, 1, 3, 10} {
+		s := newRowSorter(testEnv, order, limit)
+		for i, v := range values {
+			s.Add(map[string]interface{}{"i": i, "v": v})
+		}
+		var got []int
+		for _, row := range s.Rows() {
+			got = append(got, row["i"].(int))
+		}
+		// Ties keep the order they were added in.
+		want := []int{2, 4, 5, 0, 3, 1}
+		if limit > 0 && limit < len(want) {
+			want = want[:limit]
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("LIMIT %d: got %v, want %v", limit, got, want)
+		}
+	}
+}
+
+func TestFillBuckets(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	tests := []struct {
+		loc   *time.Location
+		query string
+		ts    []string
+		want  []string
+	}{
+		{
+			time.UTC,
+			"MAP _ts, v REDUCE SUM v ON hour(_ts)",
+			[]string{"2023-11-05T04:30:00Z", "2023-11-05T07:10:00Z"},
+			[]string{"2023-11-05T04:00:00Z", "2023-11-05T05:00:00Z", "2023-11-05T06:00:00Z", "2023-11-05T07:00:00Z"},
+		},
+		{
+			time.UTC,
+			"MAP bucket(_ts, 30m) AS b, v REDUCE SUM v ON b",
+			[]string{"2023-11-05T04:30:00Z", "2023-11-05T05:40:00Z"},
+			[]string{"2023-11-05T04:30:00Z", "2023-11-05T05:00:00Z", "2023-11-05T05:30:00Z"},
+		},
+		// The hour from 01:00 to 02:00 happens twice on the night DST ends.
+		{
+			ny,
+			"MAP hour(_ts) AS h, v REDUCE SUM v ON h",
+			[]string{"2023-11-05T04:30:00Z", "2023-11-05T06:30:00Z", "2023-11-05T08:30:00Z"},
+			[]string{"2023-11-05T04:00:00Z", "2023-11-05T05:00:00Z", "2023-11-05T06:00:00Z", "2023-11-05T07:00:00Z", "2023-11-05T08:00:00Z"},
+		},
+		{
+			ny,
+			"MAP _ts, v REDUCE SUM v ON day(_ts)",
+			[]string{"2023-11-04T12:00:00Z", "2023-11-06T12:00:00Z"},
+			[]string{"2023-11-04T04:00:00Z", "2023-11-05T04:00:00Z", "2023-11-06T05:00:00Z"},
+		},
+	}
+	for _, test := range tests {
+		rows := make([]map[string]interface{}, len(test.ts))
+		for i, ts := range test.ts {
+			parsed, _ := time.Parse(time.RFC3339, ts)
+			rows[i] = map[string]interface{}{"_ts": float64(parsed.Unix()), "v": 1.0}
+		}
+		result := reduceRows(t, &Engine{Location: test.loc}, test.query, rows).reducedResult()
+
+		want := make([]string, len(test.want))
+		for i, ts := range test.want {
+			parsed, _ := time.Parse(time.RFC3339, ts)
+			want[i] = keyString(float64(parsed.Unix()))
+		}
+		got := make([]string, 0, len(result))
+		for name := range result {
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("%s in %s: got buckets %v, want %v", test.query, test.loc, got, want)
+		}
+	}
+}
+
+func TestHaving(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"a": "x", "v": 1.0},
+		{"a": "y", "v": 5.0},
+		{"a": "y", "v": 6.0},
+		{"a": "z", "v": 20.0},
+		{"a": "w", "v": nil},
+	}
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"MAP a, v REDUCE SUM v ON a HAVING SUM v > 10", "y z"},
+		{"MAP a, v REDUCE SUM v ON a HAVING COUNT v >= 2", "y"},
+		{"MAP a, v REDUCE SUM v AS total ON a HAVING total > 10 AND _count = 1", "z"},
+		{"MAP a, v REDUCE SUM v ON a HAVING MAX v - MIN v = 1", "y"},
+		{"MAP a, v REDUCE SUM v ON a HAVING -SUM v < -10", "y z"},
+		{"MAP a, v REDUCE SUM v ON a HAVING a IN (\"x\", \"w\")", "w x"},
+		{"MAP a, v REDUCE SUM v ON a HAVING MAX v IS NULL", "w"},
+		{"MAP a, v REDUCE SUM v WHERE _count > 1 ON a", "y"},
+		{"MAP a, v REDUCE HAVING _count > 1 ON a", "y"},
+		{"MAP a, v REDUCE SUM v ON a HAVING NOT SUM v > 10 ORDER BY a", "w x"},
+	}
+	for _, test := range tests {
+		x := reduceRows(t, &Engine{}, test.query, rows)
+		var got []string
+		for _, row := range x.reducedRows() {
+			got = append(got, row["a"].(string))
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestHavingErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		msg   string
+	}{
+		{"MAP a, v REDUCE v ON a", `"v" in REDUCE must be aggregated, or be a REDUCE key or field`},
+		{"MAP a, v REDUCE SUM v, -v ON a", `"v" in REDUCE must be aggregated, or be a REDUCE key or field`},
+		{"MAP a, v REDUCE SUM v ON a HAVING v > 1", `"v" in HAVING must be aggregated, or be a REDUCE key or field`},
+		{"MAP a, v REDUCE SUM v ON a HAVING SUM x > 1", `"x" in SUM must be a MAP field`},
+		{"MAP a, v REDUCE SUM v ON a HAVING EXISTS(v)", `"v" in HAVING must be a REDUCE key or field`},
+		{"MAP a, v REDUCE SUM v WHERE _count > 1 ON a HAVING _count > 2", "REDUCE already has a HAVING condition"},
+		{"MAP a, v REDUCE SUM v ON a HAVING SUM v", "found end of query, expected =, !=, <, <=, >, >=, IS, IN, NOT IN, LIKE, ILIKE or MATCHES"},
+	}
+	for _, test := range tests {
+		err := parseError(test.query)
+		if pe, ok := err.(*ParseError); !ok || pe.Msg != test.msg {
+			t.Errorf("%s: got %v, want %q", test.query, err, test.msg)
+		}
+	}
+	if err := parseError("MAP having, v REDUCE SUM v AS having_sum ON having HAVING having_sum > 1"); err != nil {
+		t.Errorf("HAVING as a name: %v", err)
+	}
+}
+
+func TestDistinctCount(t *testing.T) {
+	rows := make([]map[string]interface{}, 0, 20000)
+	for i := 0; i < 10000; i++ {
+		rows = append(rows, map[string]interface{}{"v": float64(i)}, map[string]interface{}{"v": fmt.Sprint(i % 10)})
+	}
+	rows = append(rows, map[string]interface{}{"v": nil})
+	g := reduceRows(t, &Engine{}, "MAP v REDUCE DISTINCT_COUNT v, APPROX_DISTINCT_COUNT v ON 1", rows).reducedResult()["1"].(map[string]interface{})
+
+	// DISTINCT_COUNT is exact however many values it sees.
+	if got := g["DISTINCT_COUNT v"]; got != 10010 {
+		t.Errorf("DISTINCT_COUNT: got %v, want 10010", got)
+	}
+	if got := g["APPROX_DISTINCT_COUNT v"].(int); got < 9700 || got > 10300 {
+		t.Errorf("APPROX_DISTINCT_COUNT: got %d, want about 10010", got)
+	}
+
+	if err := parseError("MAP approx_distinct_count, a REDUCE APPROX_DISTINCT_COUNT a ON approx_distinct_count"); err != nil {
+		t.Errorf("APPROX_DISTINCT_COUNT as a name: %v", err)
+	}
+}
+
+func TestExecuteWorkers(t *testing.T) {
+	store, tr := testStore(t, 6, 50)
+	queries := []string{
+		"MAP _ts, user WHERE revenue > 7",
+		// Ties keep the order events were scanned in.
+		"MAP _ts, user, revenue ORDER BY revenue DESC LIMIT 15",
+		"MAP user, revenue ORDER BY revenue",
+		"MAP country, revenue REDUCE SUM revenue, AVG revenue, MAX revenue ON country",
+		"MAP country, user, revenue REDUCE DISTINCT_COUNT user, APPROX_DISTINCT_COUNT user ON country",
+		"MAP country, revenue REDUCE SUM revenue ON country HAVING _count > 40 ORDER BY SUM revenue DESC, country LIMIT 3",
+		"MAP _ts, revenue REDUCE SUM revenue ON day(_ts)",
+	}
+	for _, text := range queries {
+		q, err := Parse(text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		var want []byte
+		for _, workers := range []int{1, 2, 3, 8} {
+			result, err := (&Engine{Workers: workers}).Execute(context.Background(), store, q, tr)
+			if err != nil {
+				t.Fatalf("%s with %d workers: %v", text, workers, err)
+			}
+			got, err := json.Marshal(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want == nil {
+				want = got
+			} else if string(got) != string(want) {
+				t.Errorf("%s with %d workers: got %s, want %s", text, workers, got, want)
+			}
+		}
+	}
+}
+
+func TestExecuteCanceled(t *testing.T) {
+	store, tr := testStore(t, 5, 100)
+	queries := []string{
+		"MAP country",
+		"MAP country ORDER BY country LIMIT 3",
+		"MAP country, revenue REDUCE SUM revenue ON country",
+		"MAP _ts, revenue REDUCE SUM revenue ON hour(_ts)",
+	}
+	for _, text := range queries {
+		q, err := Parse(text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+
+		canceled, cancel := context.WithCancel(context.Background())
+		cancel()
+		timedOut, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+		defer cancel()
+		contexts := []struct {
+			ctx  context.Context
+			want error
+		}{
+			{canceled, context.Canceled},
+			{timedOut, context.DeadlineExceeded},
+		}
+		for _, c := range contexts {
+			for _, workers := range []int{1, 2, 8} {
+				res, err := (&Engine{Workers: workers}).Execute(c.ctx, store, q, tr)
+				var canceledErr *CanceledError
+				if !errors.As(err, &canceledErr) || !errors.Is(err, c.want) {
+					t.Errorf("%s with %d workers: got %v, %v, want a *CanceledError for %v", text, workers, res, err, c.want)
+				}
+			}
+		}
+	}
+}
+
+func TestFillBucketsCanceled(t *testing.T) {
+	// Two events years apart leave tens of thousands of hours to fill.
+	rows := []map[string]interface{}{{"_ts": 0.0}, {"_ts": 1e8}}
+	q, err := Parse("MAP _ts REDUCE COUNT _ts ON hour(_ts)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := newExecution(&Engine{}, q)
+	for _, row := range rows {
+		x.accumulate(row)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := x.fillBuckets(ctx); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestExecuteSpill(t *testing.T) {
+	store, tr := testStore(t, 3, 500)
+	queries := []string{
+		"MAP user, country, revenue REDUCE SUM revenue, DISTINCT_COUNT country, APPROX_DISTINCT_COUNT country ON user",
+		"MAP user, revenue REDUCE SUM revenue AS s ON user ORDER BY s DESC, user LIMIT 5",
+		"MAP user, revenue REDUCE SUM revenue AS s ON user HAVING s > 20 ORDER BY user",
+	}
+	for _, text := range queries {
+		q, err := Parse(text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		want, err := (&Engine{Workers: 1}).Execute(context.Background(), store, q, tr)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+
+		x := newExecution(&Engine{MemoryLimit: 4096, TempDir: t.TempDir()}, q)
+		defer x.closeSpill()
+		files, err := store.Files(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := x.scan(context.Background(), store, files, &timeRange{start: tr.Start.Unix(), end: tr.End.Unix()}, 4); err != nil {
+			t.Fatalf("%s, spilling: %v", text, err)
+		}
+		if len(x.runs) == 0 {
+			t.Errorf("%s: no groups were spilled", text)
+		}
+		got, err := x.result(context.Background())
+		if err != nil {
+			t.Fatalf("%s, spilling: %v", text, err)
+		}
+		if !reflect.DeepEqual(got.Rows, want.Rows) || !reflect.DeepEqual(got.Groups, want.Groups) {
+			t.Errorf("%s: spilling gave\n%v %v\nwant\n%v %v", text, got.Rows, got.Groups, want.Rows, want.Groups)
+		}
+	}
+}
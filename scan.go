@@ -0,0 +1,254 @@
+package gofigure
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// chunkSize is how many bytes of a file a single worker scans. Larger files
+// are split into chunks at line boundaries, if the store's files can be read
+// at random.
+const chunkSize = 16 << 20
+
+// checkInterval is how many lines or groups are processed between checks for
+// the query being cancelled.
+const checkInterval = 1024
+
+// chunkable is implemented by files, such as *os.File, that can be split into
+// chunks scanned in parallel.
+type chunkable interface {
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// scanFile is an open file shared by the units scanning it.
+type scanFile struct {
+	rc io.ReadCloser
+	// within is the range each event's _ts is checked against, nil for files
+	// entirely inside the query's range.
+	within *timeRange
+	// refs counts the units yet to finish with the file, plus one held while
+	// its units are being queued. The last to finish closes it.
+	refs int32
+}
+
+func (f *scanFile) release(n int32) {
+	if atomic.AddInt32(&f.refs, -n) == 0 {
+		f.rc.Close()
+	}
+}
+
+// scanUnit is a file, or a chunk of one, scanned into its own partial
+// execution. Units are numbered in file and chunk order, the order their
+// partials are merged in, so results don't depend on which worker finishes
+// first.
+type scanUnit struct {
+	seq  int
+	file *scanFile
+	// start and end are the byte offsets of the lines the unit maps, by where
+	// each line starts. An end of -1 means the whole file, read in sequence.
+	start int64
+	end   int64
+	// last is set on the file's last unit.
+	last bool
+	part *execution
+	err  error
+}
+
+// scan maps the events in files, scanning up to workers files or chunks at
+// once and merging their partial results into x in order.
+func (x *execution) scan(ctx context.Context, store Store, files []string, within *timeRange, workers int) error {
+	// Stop queueing units after an error; workers check ctx itself, so only
+	// the caller cancelling it fails the units in flight.
+	queueCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	units := make(chan *scanUnit)
+	done := make(chan *scanUnit)
+	// tokens bound how many units are queued, scanning or waiting to be
+	// merged, and so how many partials are held at once.
+	tokens := make(chan struct{}, 2*workers)
+
+	go func() {
+		defer close(units)
+		seq := 0
+		queue := func(u *scanUnit) bool {
+			u.seq = seq
+			seq++
+			select {
+			case tokens <- struct{}{}:
+			case <-queueCtx.Done():
+				return false
+			}
+			select {
+			case units <- u:
+				return true
+			case <-queueCtx.Done():
+				<-tokens
+				return false
+			}
+		}
+
+		for _, name := range files {
+			// Only check each event's _ts in files the range cuts through.
+			fileWithin := within
+			if start, end, ok := FileSpan(name); ok && within.start <= start && end <= within.end {
+				fileWithin = nil
+			}
+			chunks, f, err := x.openChunks(store, name, fileWithin)
+			if err != nil {
+				queue(&scanUnit{err: err})
+				return
+			}
+			for i, u := range chunks {
+				if !queue(u) {
+					f.release(int32(len(chunks) - i + 1))
+					return
+				}
+			}
+			f.release(1)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range units {
+				if u.err == nil {
+					u.err = ctx.Err()
+				}
+				if u.err == nil {
+					u.part = x.fork()
+					u.err = u.part.scanChunk(ctx, u)
+				}
+				if u.file != nil {
+					u.file.release(1)
+				}
+				done <- u
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	pending := make(map[int]*scanUnit)
+	next := 0
+	for u := range done {
+		pending[u.seq] = u
+		for u, ok := pending[next]; ok; u, ok = pending[next] {
+			delete(pending, next)
+			next++
+			if u.err != nil && err == nil {
+				err = u.err
+				cancel()
+			}
+			if err == nil {
+				if err = x.merge(u.part); err != nil {
+					cancel()
+				} else if u.last {
+					atomic.AddInt64(&x.progress.filesScanned, 1)
+				}
+			}
+			<-tokens
+		}
+	}
+	if err == nil {
+		// Once ctx is done the producer stops queueing without a unit to
+		// say so, leaving files unscanned.
+		err = ctx.Err()
+	}
+	return err
+}
+
+// openChunks opens the named file and splits it into the units to scan it
+// with.
+func (x *execution) openChunks(store Store, name string, within *timeRange) ([]*scanUnit, *scanFile, error) {
+	rc, err := store.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &scanFile{rc: rc, within: within}
+
+	var size int64
+	if c, ok := rc.(chunkable); ok {
+		if info, err := c.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	if size <= chunkSize {
+		f.refs = 2
+		return []*scanUnit{{file: f, end: -1, last: true}}, f, nil
+	}
+
+	chunks := make([]*scanUnit, 0, size/chunkSize+1)
+	for start := int64(0); start < size; start += chunkSize {
+		chunks = append(chunks, &scanUnit{file: f, start: start, end: start + chunkSize})
+	}
+	chunks[len(chunks)-1].last = true
+	f.refs = int32(len(chunks)) + 1
+	return chunks, f, nil
+}
+
+// scanChunk maps every event in the unit's part of its file. Chunks read on
+// past their end to finish the line they end in, and skip the line they
+// start in unless it starts exactly at their start. It stops with ctx's error
+// if ctx is done first.
+func (x *execution) scanChunk(ctx context.Context, u *scanUnit) error {
+	var r io.Reader = u.file.rc
+	pos := u.start
+	if u.end >= 0 {
+		c := u.file.rc.(chunkable)
+		if pos > 0 {
+			// Read from the byte before, so that when a line starts exactly
+			// at the chunk's start, the line skipped is the empty one before.
+			pos--
+		}
+		r = io.NewSectionReader(c, pos, 1<<62)
+	}
+
+	// Track where each line starts by counting what the scanner consumes.
+	next := pos
+	scanner := bufio.NewScanner(r)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		next += int64(advance)
+		return advance, token, err
+	})
+
+	var lines, invalid, rows int64
+	defer func() { x.progress.add(lines, invalid, rows) }()
+	skip := u.start > 0
+	for lineStart := pos; scanner.Scan(); lineStart = next {
+		if skip {
+			skip = false
+			continue
+		}
+		if u.end >= 0 && lineStart >= u.end {
+			break
+		}
+		switch x._map(scanner.Text(), u.file.within) {
+		case mapKept:
+			rows++
+		case mapInvalid:
+			invalid++
+		}
+		if lines++; lines%checkInterval == 0 {
+			x.progress.add(lines, invalid, rows)
+			lines, invalid, rows = 0, 0, 0
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return scanner.Err()
+}
@@ -1,25 +1,50 @@
-package main
+package gofigure
 
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// Pos is a position in the query text. Line and Column start at 1 and
+// Column counts runes; Offset is in bytes.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
 // Scanner represents a lexical scanner.
 type Scanner struct {
 	r *bufio.Reader
+
+	pos    Pos    // position of the next rune
+	prev   Pos    // position before the last read, restored by unread
+	tokPos Pos    // position of the last scanned token
+	errMsg string // why the last token was ILLEGAL, if known
 }
 
 // NewScanner returns a new instance of Scanner.
 func NewScanner(r io.Reader) *Scanner {
-	return &Scanner{r: bufio.NewReader(r)}
+	return &Scanner{r: bufio.NewReader(r), pos: Pos{Line: 1, Column: 1}}
 }
 
+// Pos returns the position of the first rune of the last scanned token.
+func (s *Scanner) Pos() Pos { return s.tokPos }
+
+// Err describes what was wrong with the last scanned token if it was
+// ILLEGAL, such as an unterminated string. It is empty otherwise.
+func (s *Scanner) Err() string { return s.errMsg }
+
 // Scan returns the next token and literal value.
 func (s *Scanner) Scan() (tok Token, lit string) {
+	s.tokPos = s.pos
+	s.errMsg = ""
+
 	// Read the next rune.
 	ch := s.read()
 
@@ -33,6 +58,22 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 		return EOF, ""
 	} else if ch == ',' {
 		return COMMA, string(ch)
+	} else if ch == '(' {
+		return LPAREN, string(ch)
+	} else if ch == ')' {
+		return RPAREN, string(ch)
+	} else if ch == '+' {
+		return ADD, string(ch)
+	} else if ch == '-' {
+		return SUBTRACT, string(ch)
+	} else if ch == '*' {
+		return MULTIPLY, string(ch)
+	} else if ch == '/' {
+		return DIVIDE, string(ch)
+	} else if ch == '`' {
+		return s.scanQuotedIdent()
+	} else if ch == '"' || ch == '\'' {
+		return s.scanString(ch)
 	} else if isValidCh(ch) {
 		s.unread()
 		return s.scanToken()
@@ -41,6 +82,28 @@ func (s *Scanner) Scan() (tok Token, lit string) {
 	return ILLEGAL, string(ch)
 }
 
+// scanQuotedIdent consumes an identifier quoted in backticks, the opening
+// one already read. A quoted identifier is never a keyword, so "`order`"
+// names a property even where ORDER would start a clause.
+func (s *Scanner) scanQuotedIdent() (tok Token, lit string) {
+	var buf bytes.Buffer
+	for {
+		if ch := s.read(); ch == eof || ch == '\n' {
+			s.errMsg = "unterminated quoted identifier"
+			return ILLEGAL, "`" + buf.String()
+		} else if ch == '`' {
+			break
+		} else {
+			buf.WriteRune(ch)
+		}
+	}
+	if buf.Len() == 0 {
+		s.errMsg = "empty quoted identifier"
+		return ILLEGAL, "``"
+	}
+	return IDENT, buf.String()
+}
+
 // scanWhitespace consumes the current rune and all contiguous whitespace.
 func (s *Scanner) scanWhitespace() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
@@ -67,14 +130,20 @@ func (s *Scanner) scanWhitespace() (tok Token, lit string) {
 func (s *Scanner) scanToken() (tok Token, lit string) {
 	// Create a buffer and read the current character into it.
 	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	first := s.read()
+	buf.WriteRune(first)
 
 	// Read every subsequent ident character into the buffer.
-	// Non-ident characters and EOF will cause the loop to exit.
+	// Non-ident characters and EOF will cause the loop to exit. Arithmetic
+	// operators end a token so "price*quantity" scans as three, and
+	// comparison operators are kept apart from idents so "a=1" does too.
 	for {
 		if ch := s.read(); ch == eof {
 			break
-		} else if isWhitespace(ch) || !isValidCh(ch) {
+		} else if (ch == '+' || ch == '-') && isExponent(buf.String()) {
+			// The sign of an exponent, as in "1.5e-3".
+			_, _ = buf.WriteRune(ch)
+		} else if isWhitespace(ch) || !isValidCh(ch) || isArithmetic(ch) || ch == '"' || ch == '\'' || isComparison(ch) != isComparison(first) {
 			s.unread()
 			break
 		} else {
@@ -94,12 +163,54 @@ func (s *Scanner) scanToken() (tok Token, lit string) {
 		return WHERE, buf.String()
 	case "AND":
 		return AND, buf.String()
+	case "OR":
+		return OR, buf.String()
+	case "NOT":
+		return NOT, buf.String()
 	case "IN":
 		return IN, buf.String()
+	case "AS":
+		return AS, buf.String()
+	case "ORDER":
+		return ORDER, buf.String()
+	case "BY":
+		return BY, buf.String()
+	case "ASC":
+		return ASC, buf.String()
+	case "DESC":
+		return DESC, buf.String()
+	case "LIMIT":
+		return LIMIT, buf.String()
+	case "IS":
+		return IS, buf.String()
+	case "EXISTS":
+		return EXISTS, buf.String()
+	case "LIKE":
+		return LIKE, buf.String()
+	case "ILIKE":
+		return ILIKE, buf.String()
+	case "MATCHES":
+		return MATCHES, buf.String()
+	case "HAVING":
+		return HAVING, buf.String()
 	case "SUM":
 		return SUM, buf.String()
 	case "COUNT":
 		return COUNT, buf.String()
+	case "AVG":
+		return AVG, buf.String()
+	case "MIN":
+		return MIN, buf.String()
+	case "MAX":
+		return MAX, buf.String()
+	case "DISTINCT_COUNT":
+		return DISTINCT_COUNT, buf.String()
+	case "APPROX_DISTINCT_COUNT":
+		return APPROX_DISTINCT_COUNT, buf.String()
+	case "TRUE", "FALSE":
+		return BOOLEAN, buf.String()
+	case "NULL":
+		return NULL, buf.String()
 	}
 
 	// Match operators
@@ -118,33 +229,93 @@ func (s *Scanner) scanToken() (tok Token, lit string) {
 		return NOT_EQ, buf.String()
 	}
 
-	// Check for string literal or ident
-	var str string = buf.String()
-	if str[0] == '"' && str[len(str)-1] == '"' {
-		str = str[1 : len(str)-1]
-		return STRING, str
-	}
-
 	// Check for number
-	if match, _ := regexp.MatchString("([0-9.]+)", buf.String()); match {
+	if numberPattern.MatchString(buf.String()) {
 		return NUMBER, buf.String()
 	}
 
+	// Check for duration
+	if match, _ := regexp.MatchString("^[0-9]+[smhdw]$", buf.String()); match {
+		return DURATION, buf.String()
+	}
+
 	return IDENT, buf.String()
 }
 
+// scanString consumes a string literal opened by quote, which has already
+// been read, and returns its unescaped value.
+func (s *Scanner) scanString(quote rune) (tok Token, lit string) {
+	var buf bytes.Buffer
+	for {
+		ch := s.read()
+		if ch == eof || ch == '\n' {
+			s.errMsg = "unterminated string literal"
+			return ILLEGAL, string(quote) + buf.String()
+		} else if ch == quote {
+			return STRING, buf.String()
+		} else if ch != '\\' {
+			buf.WriteRune(ch)
+			continue
+		}
+
+		switch esc := s.read(); esc {
+		case '"', '\'', '\\':
+			buf.WriteRune(esc)
+		case 'n':
+			buf.WriteRune('\n')
+		case 't':
+			buf.WriteRune('\t')
+		case 'r':
+			buf.WriteRune('\r')
+		case 'u':
+			var hex bytes.Buffer
+			for i := 0; i < 4; i++ {
+				if ch := s.read(); ch != eof {
+					hex.WriteRune(ch)
+				}
+			}
+			v, err := strconv.ParseUint(hex.String(), 16, 16)
+			if err != nil {
+				s.errMsg = fmt.Sprintf("invalid escape \\u%s in string literal", hex.String())
+				return ILLEGAL, string(quote) + buf.String()
+			}
+			buf.WriteRune(rune(v))
+		default:
+			if esc == eof {
+				s.errMsg = "unterminated string literal"
+			} else {
+				s.errMsg = fmt.Sprintf("invalid escape \\%c in string literal", esc)
+			}
+			return ILLEGAL, string(quote) + buf.String()
+		}
+	}
+}
+
 // read reads the next rune from the bufferred reader.
 // Returns the rune(0) if an error occurs (or io.EOF is returned).
 func (s *Scanner) read() rune {
-	ch, _, err := s.r.ReadRune()
+	ch, size, err := s.r.ReadRune()
 	if err != nil {
+		s.prev = s.pos
 		return eof
 	}
+	s.prev = s.pos
+	s.pos.Offset += size
+	if ch == '\n' {
+		s.pos.Line++
+		s.pos.Column = 1
+	} else {
+		s.pos.Column++
+	}
 	return ch
 }
 
 // unread places the previously read rune back on the reader.
-func (s *Scanner) unread() { _ = s.r.UnreadRune() }
+func (s *Scanner) unread() {
+	if s.r.UnreadRune() == nil {
+		s.pos = s.prev
+	}
+}
 
 // isWhitespace returns true if the rune is a space, tab, or newline.
 func isWhitespace(ch rune) bool { return ch == ' ' || ch == '\t' || ch == '\n' }
@@ -155,13 +326,30 @@ func isLetter(ch rune) bool { return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && c
 // isDigit returns true if the rune is a digit.
 func isDigit(ch rune) bool { return (ch >= '0' && ch <= '9') }
 
+// isArithmetic returns true if the rune is an arithmetic operator.
+func isArithmetic(ch rune) bool { return ch == '+' || ch == '-' || ch == '/' || ch == '*' }
+
+// isComparison returns true if the rune can be part of a comparison operator.
+func isComparison(ch rune) bool { return ch == '<' || ch == '>' || ch == '=' || ch == '!' }
+
 func isOperator(ch rune) bool {
 	return (ch == '<' || ch == '>' || ch == '=' || ch == '+' || ch == '-' || ch == '/' || ch == '*')
 }
 
 func isValidCh(ch rune) bool {
-	return isWhitespace(ch) || isLetter(ch) || isDigit(ch) || isOperator(ch) || ch == '_' || ch == '"' || ch == '.' || ch == '@' || ch == '!'
+	return isWhitespace(ch) || isLetter(ch) || isDigit(ch) || isOperator(ch) || ch == '_' || ch == '.' || ch == '@' || ch == '!' || ch == '[' || ch == ']'
 }
 
+// numberPattern matches unsigned integer, decimal and scientific notation
+// numbers. Signs are parsed as unary operators.
+var numberPattern = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)([eE][+-]?[0-9]+)?$`)
+
+// exponentPattern matches a number up to the "e" of its exponent.
+var exponentPattern = regexp.MustCompile(`^([0-9]+\.?[0-9]*|\.[0-9]+)[eE]$`)
+
+// isExponent returns true if lit is a number followed by the "e" of an
+// exponent, so a following + or - is the exponent's sign.
+func isExponent(lit string) bool { return exponentPattern.MatchString(lit) }
+
 // eof represents a marker rune for the end of the reader.
 var eof = rune(0)
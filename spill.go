@@ -0,0 +1,339 @@
+package gofigure
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// groupOverhead estimates the bytes a group takes besides its id and its
+// states: the group itself, its map entry and its keys.
+const groupOverhead = 128
+
+// size estimates the bytes g takes in memory, stored under id.
+func (g *group) size(id string) int {
+	n := groupOverhead + 2*len(id)
+	for _, s := range g.states {
+		n += s.size()
+	}
+	return n
+}
+
+// spillRun is a file of groups spilled by one call to spill, sorted by id.
+type spillRun struct {
+	file *os.File
+	seq  int
+	r    *spillReader
+	// left is how many groups are yet to be read. id and g hold the group
+	// last read.
+	left int
+	id   string
+	g    *group
+}
+
+// spill writes the groups in memory to a new run in a temporary file, sorted
+// by id, and empties x.groups.
+func (x *execution) spill() error {
+	ids := make([]string, 0, len(x.groups))
+	for id := range x.groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	f, err := os.CreateTemp(x.tempDir, "gofigure-reduce-*")
+	if err != nil {
+		return err
+	}
+	// Add the run first, so closeSpill removes the file if writing fails.
+	x.runs = append(x.runs, &spillRun{file: f, seq: len(x.runs), left: len(ids)})
+
+	w := &spillWriter{w: bufio.NewWriter(f)}
+	for _, id := range ids {
+		g := x.groups[id]
+		w.string(id)
+		for _, k := range g.keys {
+			w.value(k)
+		}
+		w.uvarint(uint64(g.count))
+		for _, s := range g.states {
+			s.encode(w)
+		}
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	x.groups = make(map[string]*group)
+	x.groupBytes = 0
+	return nil
+}
+
+// mergeSpilled spills what groups are left in memory, then merges the runs
+// back into x.groups one group at a time, reducing each as it is completed
+// so only the reduced columns stay in memory. Groups HAVING filters out are
+// dropped, unless gap-filling needs to see them. With no gaps to fill, the
+// groups of an ordered output go straight to x.sorter instead, so only those
+// it keeps stay in memory.
+func (x *execution) mergeSpilled(ctx context.Context) error {
+	if err := x.spill(); err != nil {
+		return err
+	}
+
+	h := make(spillHeap, 0, len(x.runs))
+	for _, run := range x.runs {
+		if _, err := run.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		run.r = &spillReader{r: bufio.NewReader(run.file)}
+		if run.left > 0 {
+			if err := x.readSpilled(run); err != nil {
+				return err
+			}
+			h = append(h, run)
+		}
+	}
+	heap.Init(&h)
+
+	keepDropped := x.timeBucketKey() != nil
+	n := 0
+	for h.Len() > 0 {
+		if n++; n%checkInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		// Ties pop in run order, so states merge in the order they were
+		// scanned.
+		id, g := h[0].id, h[0].g
+		for first := true; h.Len() > 0 && h[0].id == id; first = false {
+			run := h[0]
+			if !first {
+				g.count += run.g.count
+				for i, state := range g.states {
+					state.merge(run.g.states[i])
+				}
+			}
+			if run.left == 0 {
+				heap.Pop(&h)
+			} else if err := x.readSpilled(run); err != nil {
+				return err
+			} else {
+				heap.Fix(&h, 0)
+			}
+		}
+
+		x.progress.groups++
+		keep := x.reduceGroup(g)
+		if x.sorter != nil && !keepDropped {
+			if keep {
+				x.sorter.Add(x.groupRow(g))
+			}
+		} else if keep || keepDropped {
+			g.dropped = !keep
+			x.groups[id] = g
+		}
+	}
+	return nil
+}
+
+// readSpilled reads the next group of a run.
+func (x *execution) readSpilled(run *spillRun) error {
+	r := run.r
+	run.id = r.string()
+	keys := make([]interface{}, len(x.q.Reduce.Keys))
+	for i := range keys {
+		keys[i] = r.value()
+	}
+	g := x.newGroup(keys)
+	g.count = int(r.uvarint())
+	for _, s := range g.states {
+		s.decode(r)
+	}
+	if r.err != nil {
+		return fmt.Errorf("reading spilled groups: %w", r.err)
+	}
+	run.g = g
+	run.left--
+	return nil
+}
+
+// closeSpill closes and removes the execution's spill files.
+func (x *execution) closeSpill() {
+	for _, run := range x.runs {
+		run.file.Close()
+		os.Remove(run.file.Name())
+	}
+	x.runs = nil
+}
+
+// spillHeap orders runs by the id of their current group, then by run.
+type spillHeap []*spillRun
+
+func (h spillHeap) Len() int { return len(h) }
+
+func (h spillHeap) Less(i, j int) bool {
+	if h[i].id != h[j].id {
+		return h[i].id < h[j].id
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h spillHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *spillHeap) Push(x interface{}) {
+	*h = append(*h, x.(*spillRun))
+}
+
+func (h *spillHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// Tags of the values in spill files.
+const (
+	spillNull = iota
+	spillFalse
+	spillTrue
+	spillInt
+	spillFloat
+	spillString
+	// spillJSON is any other value, such as a list, as JSON.
+	spillJSON
+)
+
+// spillWriter encodes groups to a spill file. Errors are kept and returned
+// by flush.
+type spillWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *spillWriter) uvarint(n uint64) {
+	w.w.Write(w.buf[:binary.PutUvarint(w.buf[:], n)])
+}
+
+func (w *spillWriter) float(f float64) {
+	binary.LittleEndian.PutUint64(w.buf[:8], math.Float64bits(f))
+	w.w.Write(w.buf[:8])
+}
+
+func (w *spillWriter) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.w.Write(b)
+}
+
+func (w *spillWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+// value writes an event value, keeping whether numbers are ints or floats.
+func (w *spillWriter) value(v interface{}) {
+	if v == nil {
+		w.uvarint(spillNull)
+	} else if b, ok := v.(bool); ok {
+		if b {
+			w.uvarint(spillTrue)
+		} else {
+			w.uvarint(spillFalse)
+		}
+	} else if i, ok := v.(int); ok {
+		w.uvarint(spillInt)
+		w.w.Write(w.buf[:binary.PutVarint(w.buf[:], int64(i))])
+	} else if f, ok := v.(float64); ok {
+		w.uvarint(spillFloat)
+		w.float(f)
+	} else if s, ok := v.(string); ok {
+		w.uvarint(spillString)
+		w.string(s)
+	} else if data, err := json.Marshal(v); err == nil {
+		w.uvarint(spillJSON)
+		w.bytes(data)
+	} else if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *spillWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// spillReader decodes what a spillWriter wrote. After an error, reads
+// return zero values and err holds the first error.
+type spillReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (r *spillReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(r.r)
+	r.err = err
+	return n
+}
+
+func (r *spillReader) float() float64 {
+	if r.err != nil {
+		return 0
+	}
+	var b [8]byte
+	_, r.err = io.ReadFull(r.r, b[:])
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (r *spillReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, r.err = io.ReadFull(r.r, b)
+	return b
+}
+
+func (r *spillReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *spillReader) value() interface{} {
+	switch r.uvarint() {
+	case spillFalse:
+		return false
+	case spillTrue:
+		return true
+	case spillInt:
+		if r.err != nil {
+			return nil
+		}
+		i, err := binary.ReadVarint(r.r)
+		r.err = err
+		return int(i)
+	case spillFloat:
+		return r.float()
+	case spillString:
+		return r.string()
+	case spillJSON:
+		var v interface{}
+		if data := r.bytes(); r.err == nil {
+			r.err = json.Unmarshal(data, &v)
+		}
+		return v
+	}
+	return nil
+}
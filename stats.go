@@ -0,0 +1,115 @@
+package gofigure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// Stats counts the work done running a query.
+type Stats struct {
+	// Files are the files the time range selected, in scan order.
+	Files []string `json:"files"`
+	// FilesSelected is how many files the time range selected.
+	FilesSelected int `json:"files_selected"`
+	// FilesScanned is how many of them were scanned to the end.
+	FilesScanned int `json:"files_scanned"`
+	// Lines is how many lines were read.
+	Lines int64 `json:"lines"`
+	// UnmarshalFailures is how many lines weren't valid JSON, and were
+	// skipped.
+	UnmarshalFailures int64 `json:"unmarshal_failures"`
+	// Rows is how many rows passed the MAP condition.
+	Rows int64 `json:"rows"`
+	// Groups is how many REDUCE groups the rows made, before gap-filling
+	// and HAVING.
+	Groups int `json:"groups"`
+	// SpillFiles is how many times REDUCE groups were spilled to disk.
+	SpillFiles int `json:"spill_files"`
+	// Timings is how long each phase of the query took.
+	Timings Timings `json:"timings"`
+}
+
+// Timings is how long each phase of a query took.
+type Timings struct {
+	// Files is the time taken to select the files to scan.
+	Files time.Duration
+	// Scan is the time taken to scan and map them.
+	Scan time.Duration
+	// Reduce is the time taken after the scan, reducing groups and
+	// ordering the output.
+	Reduce time.Duration
+	// Total is the time taken by the whole query.
+	Total time.Duration
+}
+
+// MarshalJSON renders the timings in milliseconds.
+func (t Timings) MarshalJSON() ([]byte, error) {
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return json.Marshal(map[string]float64{
+		"files_ms":  ms(t.Files),
+		"scan_ms":   ms(t.Scan),
+		"reduce_ms": ms(t.Reduce),
+		"total_ms":  ms(t.Total),
+	})
+}
+
+// CanceledError is returned for a query stopped by its context, having been
+// cancelled or timed out, with the work done before it stopped.
+type CanceledError struct {
+	// Err is the context's error, context.Canceled or
+	// context.DeadlineExceeded.
+	Err   error
+	Stats Stats
+}
+
+func (e *CanceledError) Error() string {
+	what := "query cancelled"
+	if errors.Is(e.Err, context.DeadlineExceeded) {
+		what = "query timed out"
+	}
+	return fmt.Sprintf("%s after scanning %d of %d files, %d lines", what, e.Stats.FilesScanned, e.Stats.FilesSelected, e.Stats.Lines)
+}
+
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// progress counts the work of an execution and its forks. Workers update
+// the counters atomically as they go, so they can be read whenever a query
+// stops.
+type progress struct {
+	files        []string
+	filesScanned int64
+	lines        int64
+	invalid      int64
+	rows         int64
+	// groups and timings are only set by the execution itself.
+	groups  int
+	timings Timings
+}
+
+func (p *progress) add(lines int64, invalid int64, rows int64) {
+	atomic.AddInt64(&p.lines, lines)
+	atomic.AddInt64(&p.invalid, invalid)
+	atomic.AddInt64(&p.rows, rows)
+}
+
+// stats returns the work done by x so far.
+func (x *execution) stats() Stats {
+	p := x.progress
+	return Stats{
+		Files:             p.files,
+		FilesSelected:     len(p.files),
+		FilesScanned:      int(atomic.LoadInt64(&p.filesScanned)),
+		Lines:             atomic.LoadInt64(&p.lines),
+		UnmarshalFailures: atomic.LoadInt64(&p.invalid),
+		Rows:              atomic.LoadInt64(&p.rows),
+		Groups:            p.groups,
+		SpillFiles:        len(x.runs),
+		Timings:           p.timings,
+	}
+}
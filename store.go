@@ -0,0 +1,54 @@
+package gofigure
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Store is a source of newline-delimited JSON event files.
+type Store interface {
+	// Files returns the names of the files that may hold events in tr, in
+	// the order they should be scanned.
+	Files(tr TimeRange) ([]string, error)
+	// Open opens a file returned by Files.
+	Open(name string) (io.ReadCloser, error)
+}
+
+// DirStore is a Store over a directory of daily files named by
+// GenerateFileName, as written by the write command.
+type DirStore struct {
+	Dir string
+}
+
+func (s DirStore) Files(tr TimeRange) ([]string, error) {
+	d, err := os.Open(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	// The end is exclusive, so a range ending at midnight skips that day's
+	// file.
+	startFile := GenerateFileName(tr.Start)
+	endFile := GenerateFileName(tr.End.Add(-time.Second))
+	files := make([]string, 0)
+	for _, name := range names {
+		if startFile <= name && name <= endFile {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (s DirStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, name))
+}
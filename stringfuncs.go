@@ -0,0 +1,174 @@
+package gofigure
+
+import (
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The string functions return nil for null or non-string arguments unless
+// noted otherwise.
+
+// substr(s, start[, length]) counts characters from 1, like SQL.
+var substrFunction = function{
+	minArgs: 2,
+	maxArgs: 3,
+	eval: func(e *env, args []interface{}) interface{} {
+		s, ok := args[0].(string)
+		start, sok := toFloat(args[1])
+		if !ok || !sok {
+			return nil
+		}
+		runes := []rune(s)
+		from := clampIndex(int(start)-1, len(runes))
+		to := len(runes)
+		if len(args) > 2 {
+			length, ok := toFloat(args[2])
+			if !ok {
+				return nil
+			}
+			to = clampIndex(int(start)-1+int(length), len(runes))
+		}
+		if to < from {
+			return ""
+		}
+		return string(runes[from:to])
+	},
+}
+
+// split(s, sep) returns the list of parts. split(s, sep, n) returns the nth
+// part, counting from 0 like items[0], or from the end if negative.
+var splitFunction = function{
+	minArgs: 2,
+	maxArgs: 3,
+	eval: func(e *env, args []interface{}) interface{} {
+		s, ok := args[0].(string)
+		sep, sepOk := args[1].(string)
+		if !ok || !sepOk {
+			return nil
+		}
+		parts := strings.Split(s, sep)
+		if len(args) == 2 {
+			list := make([]interface{}, len(parts))
+			for i, part := range parts {
+				list[i] = part
+			}
+			return list
+		}
+		n, ok := toFloat(args[2])
+		if !ok {
+			return nil
+		}
+		i := int(n)
+		if i < 0 {
+			i += len(parts)
+		}
+		if i < 0 || i >= len(parts) {
+			return nil
+		}
+		return parts[i]
+	},
+}
+
+// concat joins its arguments' text, skipping nulls.
+var concatFunction = function{
+	minArgs: 1,
+	maxArgs: math.MaxInt32,
+	eval: func(e *env, args []interface{}) interface{} {
+		var b strings.Builder
+		for _, arg := range args {
+			if s, ok := toString(arg); ok {
+				b.WriteString(s)
+			}
+		}
+		return b.String()
+	},
+}
+
+// length returns the number of characters in a string or items in a list.
+var lengthFunction = function{
+	minArgs: 1,
+	maxArgs: 1,
+	eval: func(e *env, args []interface{}) interface{} {
+		if s, ok := args[0].(string); ok {
+			return utf8.RuneCountInString(s)
+		} else if list, ok := args[0].([]interface{}); ok {
+			return len(list)
+		}
+		return nil
+	},
+}
+
+func urlHost(u *url.URL) string {
+	return u.Hostname()
+}
+
+func urlPath(u *url.URL) string {
+	if u.Path == "" && u.Host != "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// stringFunction wraps a func of one string.
+func stringFunction(fn func(string) string) function {
+	return function{
+		minArgs: 1,
+		maxArgs: 1,
+		eval: func(e *env, args []interface{}) interface{} {
+			if s, ok := args[0].(string); ok {
+				return fn(s)
+			}
+			return nil
+		},
+	}
+}
+
+// urlFunction wraps a func extracting part of a URL. URLs without a scheme,
+// such as "example.com/a", are parsed as if they had one.
+func urlFunction(fn func(*url.URL) string) function {
+	return function{
+		minArgs: 1,
+		maxArgs: 1,
+		eval: func(e *env, args []interface{}) interface{} {
+			s, ok := args[0].(string)
+			if !ok {
+				return nil
+			}
+			if !strings.Contains(s, "://") && !strings.HasPrefix(s, "/") {
+				s = "//" + s
+			}
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil
+			}
+			return fn(u)
+		},
+	}
+}
+
+// clampIndex limits i to the bounds of a sequence of length n.
+func clampIndex(i int, n int) int {
+	if i < 0 {
+		return 0
+	} else if i > n {
+		return n
+	}
+	return i
+}
+
+// toString returns the text of a string, number or boolean.
+func toString(v interface{}) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	} else if f, ok := v.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64), true
+	} else if i, ok := v.(int); ok {
+		return strconv.Itoa(i), true
+	} else if b, ok := v.(bool); ok {
+		return strconv.FormatBool(b), true
+	}
+	return "", false
+}
@@ -1,4 +1,4 @@
-package main
+package gofigure
 
 // Token represents a lexical token.
 type Token int
@@ -12,6 +12,9 @@ const (
 	// Literals
 	STRING
 	NUMBER
+	DURATION
+	BOOLEAN // true or false
+	NULL
 	IDENT
 
 	// Types
@@ -21,6 +24,8 @@ const (
 	TYPE_FLOAT
 	TYPE_PROPERTY
 	TYPE_LIST
+	TYPE_DURATION
+	TYPE_BOOL
 
 	// Operators
 	ADD      // +
@@ -34,13 +39,22 @@ const (
 	GTE      // >=
 	LTE      // <=
 	AND      // and
+	OR       // or
+	NOT      // not
 
 	// Aggregate methods
 	SUM
 	COUNT
+	AVG
+	MIN
+	MAX
+	DISTINCT_COUNT
+	APPROX_DISTINCT_COUNT
 
 	// Misc characters
-	COMMA // ,
+	COMMA  // ,
+	LPAREN // (
+	RPAREN // )
 
 	// Keywords
 	MAP
@@ -48,4 +62,16 @@ const (
 	ON
 	WHERE
 	IN
+	AS
+	ORDER
+	BY
+	ASC
+	DESC
+	LIMIT
+	IS
+	EXISTS
+	LIKE
+	ILIKE
+	MATCHES
+	HAVING
 )
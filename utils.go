@@ -1,6 +1,15 @@
-package main
+package gofigure
 import "fmt"
 import "time"
 func GenerateFileName(t time.Time) string {
     return fmt.Sprintf("%d-%02d-%02d", t.UTC().Year(), t.UTC().Month(), t.UTC().Day())
 }
+
+// FileSpan returns the [start, end) unix seconds covered by the data file
+// named by GenerateFileName.
+func FileSpan(name string) (int64, int64, bool) {
+    if t, err := time.Parse("2006-01-02", name); err == nil {
+        return t.Unix(), t.AddDate(0, 0, 1).Unix(), true
+    }
+    return 0, 0, false
+}
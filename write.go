@@ -1,62 +1,112 @@
-package main
-
-// Go provides a `flag` package supporting basic
-// command-line flag parsing. We'll use this package to
-// implement our example command-line program.
-import "encoding/json"
-import "flag"
-import "fmt"
-import "os"
-import "time"
-import "github.com/bitly/go-simplejson"
-
-func main() {
-    dataPtr := flag.String("data", "", "the data to write")
-    flag.Parse()
-	data := *dataPtr
-	if actionJson, err := simplejson.NewJson([]byte(data)); err != nil {
-        panic(err)
-    } else {
-		actionArr, err := actionJson.Array()
-		if err == nil {
-			for _, action := range actionArr {
-				jsonString, err := json.Marshal(action)
-				if err != nil {
-					fmt.Println(err)
-				}
-		
-				writeAction(string(jsonString))
-			} 
-		} else {
-			action, err := actionJson.MarshalJSON()
-			if err == nil {
-				writeAction(string(action))
-			} else {
-				panic(err)
-			}
+package gofigure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-simplejson"
+)
+
+// ErrInvalidEvent is wrapped by errors for event data that can't be written.
+var ErrInvalidEvent = errors.New("invalid event")
+
+// ValidateEvent checks that data is a single JSON object with a numeric _ts,
+// as Write needs to pick the event's daily file.
+func ValidateEvent(data []byte) error {
+	var event map[string]interface{}
+	if err := json.Unmarshal(data, &event); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("%w: event must be a JSON object", ErrInvalidEvent)
 		}
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	} else if event == nil {
+		return fmt.Errorf("%w: event must be a JSON object", ErrInvalidEvent)
+	}
+
+	if ts, ok := event["_ts"]; !ok {
+		return fmt.Errorf("%w: _ts is required", ErrInvalidEvent)
+	} else if _, ok := ts.(float64); !ok {
+		return fmt.Errorf("%w: _ts must be a number", ErrInvalidEvent)
 	}
+	return nil
 }
 
-func writeAction(action string) {
-		actionJson, err := simplejson.NewJson([]byte(action))
-		ts, _ := actionJson.Get("_ts").Int()
-		t := time.Unix(int64(ts), 0)
-		file := fmt.Sprintf("data/%s", GenerateFileName(t))
-		if _, err := os.Stat(file); err != nil {
-			_, err := os.Create(file)
+// Writer appends events to the daily files in Dir, picking the file from
+// each event's _ts. It is safe for concurrent use.
+type Writer struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+// WriteJSON writes a single JSON event or a JSON array of events. Every
+// event is validated before any is written, so a bad event in an array
+// leaves the files untouched.
+func (w *Writer) WriteJSON(data string) error {
+	actionJson, err := simplejson.NewJson([]byte(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+
+	var actions []string
+	if actionArr, err := actionJson.Array(); err == nil {
+		for i, action := range actionArr {
+			jsonString, err := json.Marshal(action)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+			}
+			if err := ValidateEvent(jsonString); err != nil {
+				return fmt.Errorf("event %d: %w", i, err)
 			}
+			actions = append(actions, string(jsonString))
 		}
-
-		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0600)
+	} else {
+		action, err := actionJson.MarshalJSON()
 		if err != nil {
-		    panic(err)
+			return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
 		}
+		if err := ValidateEvent(action); err != nil {
+			return err
+		}
+		actions = append(actions, string(action))
+	}
+
+	for _, action := range actions {
+		if err := w.Write(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends a single JSON encoded event.
+func (w *Writer) Write(action string) error {
+	actionJson, err := simplejson.NewJson([]byte(action))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvent, err)
+	}
+	// _ts may have a fraction, which is truncated to pick the file.
+	ts, err := actionJson.Get("_ts").Float64()
+	if err != nil {
+		return fmt.Errorf("%w: _ts must be a number", ErrInvalidEvent)
+	}
+	t := time.Unix(int64(ts), 0)
+	file := filepath.Join(w.Dir, GenerateFileName(t))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
-		defer f.Close()
-		if _, err = f.WriteString(action + "\n"); err != nil {
-		    panic(err)
-		}	
+	_, err = f.WriteString(action + "\n")
+	return err
 }
@@ -0,0 +1,70 @@
+package gofigure
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteTimestamp(t *testing.T) {
+	w := &Writer{Dir: t.TempDir()}
+	events := []string{
+		`{"_ts": 1700000000, "n": 1}`,
+		`{"_ts": 1700000000.5, "n": 2}`,
+		`{"_ts": 1.7e9, "n": 3}`,
+	}
+	for _, event := range events {
+		if err := ValidateEvent([]byte(event)); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+		if err := w.Write(event); err != nil {
+			t.Fatalf("%s: %v", event, err)
+		}
+	}
+
+	// All three events are in the same second.
+	name := GenerateFileName(time.Unix(1700000000, 0))
+	data, err := os.ReadFile(filepath.Join(w.Dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if !strings.Contains(string(data), event) {
+			t.Errorf("%s: not written to %s", event, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(w.Dir, GenerateFileName(time.Unix(0, 0)))); err == nil {
+		t.Errorf("events written to the epoch's file")
+	}
+
+	for _, event := range []string{`{"n": 1}`, `{"_ts": "1700000000"}`, `[1]`, `{`} {
+		if err := ValidateEvent([]byte(event)); !errors.Is(err, ErrInvalidEvent) {
+			t.Errorf("ValidateEvent(%s): got %v, want ErrInvalidEvent", event, err)
+		}
+		if err := w.Write(event); !errors.Is(err, ErrInvalidEvent) {
+			t.Errorf("Write(%s): got %v, want ErrInvalidEvent", event, err)
+		}
+	}
+}
+
+func TestWriteJSONValidatesAll(t *testing.T) {
+	w := &Writer{Dir: t.TempDir()}
+	err := w.WriteJSON(`[{"_ts": 1700000000, "n": 1}, {"n": 2}]`)
+	if !errors.Is(err, ErrInvalidEvent) {
+		t.Fatalf("got %v, want ErrInvalidEvent", err)
+	}
+	if entries, _ := os.ReadDir(w.Dir); len(entries) != 0 {
+		t.Errorf("wrote %d files for a batch with a bad event", len(entries))
+	}
+
+	if err := w.WriteJSON(`[{"_ts": 1700000000, "n": 1}, {"_ts": 1700000001, "n": 2}]`); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(w.Dir, GenerateFileName(time.Unix(1700000000, 0))))
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("wrote %d events, want 2", lines)
+	}
+}